@@ -0,0 +1,247 @@
+// Package auth contains structures and methods for obtaining and refreshing ELIXIR AAI tokens with the OAuth2 device
+// authorization grant, and for caching them between the runs.
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/elixir-oslo/lega-commander/requests"
+)
+
+const deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// defaultPollingInterval is the interval of polling the token endpoint if the issuer does not tell one, RFC 8628.
+const defaultPollingInterval = 5 * time.Second
+
+// Token structure represents the tokens issued to the user.
+type Token struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	TokenType    string    `json:"token_type,omitempty"`
+	Expiry       time.Time `json:"expiry,omitempty"`
+}
+
+// Valid method tells whether the access token is there and does not expire within the margin.
+func (t Token) Valid(margin time.Duration) bool {
+	return t.AccessToken != "" && (t.Expiry.IsZero() || time.Until(t.Expiry) > margin)
+}
+
+// DeviceAuthorization structure holds the code the user has to enter at the verification URI to authorize the device.
+type DeviceAuthorization struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// Provider interface provides methods for the device authorization flow and for refreshing tokens.
+type Provider interface {
+	Login(ctx context.Context, notify func(authorization DeviceAuthorization)) (*Token, error)
+	Refresh(ctx context.Context, refreshToken string) (*Token, error)
+}
+
+type defaultProvider struct {
+	client   requests.Client
+	issuer   string
+	clientID string
+	scope    string
+	sleep    func(ctx context.Context, duration time.Duration) error
+}
+
+// endpoints structure holds the endpoints taken from the OpenID Connect discovery document of the issuer.
+type endpoints struct {
+	DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+	TokenEndpoint               string `json:"token_endpoint"`
+}
+
+// tokenResponse structure represents the response of the token endpoint, either the tokens or the error.
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	Error        string `json:"error"`
+}
+
+// NewProvider constructs Provider of the OpenID Connect issuer for the registered client, using requests.Client.
+func NewProvider(client *requests.Client, issuer, clientID, scope string) (Provider, error) {
+	if issuer == "" {
+		return nil, errors.New("OIDC issuer is not set")
+	}
+	if clientID == "" {
+		return nil, errors.New("OIDC client ID is not set")
+	}
+	provider := defaultProvider{issuer: strings.TrimSuffix(issuer, "/"), clientID: clientID, scope: scope, sleep: requests.Sleep}
+	if client != nil {
+		provider.client = *client
+	} else {
+		provider.client = requests.NewClient(nil)
+	}
+	return provider, nil
+}
+
+// Login method performs the device authorization flow: it requests the user code, passes it to notify to be shown to
+// the user, and polls the token endpoint until the user authorizes the device, denies it, the code expires or the
+// context is done.
+func (p defaultProvider) Login(ctx context.Context, notify func(authorization DeviceAuthorization)) (*Token, error) {
+	discovered, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if discovered.DeviceAuthorizationEndpoint == "" {
+		return nil, errors.New(p.issuer + " does not support the device authorization grant")
+	}
+	response, err := p.post(ctx, discovered.DeviceAuthorizationEndpoint, url.Values{"client_id": {p.clientID}, "scope": {p.scope}})
+	if err != nil {
+		return nil, err
+	}
+	body, err := readBody(discovered.DeviceAuthorizationEndpoint, response)
+	if err != nil {
+		return nil, err
+	}
+	var authorization DeviceAuthorization
+	if err = json.Unmarshal(body, &authorization); err != nil {
+		return nil, err
+	}
+	if authorization.DeviceCode == "" || authorization.UserCode == "" {
+		return nil, errors.New("device authorization response is missing the device or the user code")
+	}
+	notify(authorization)
+	interval := defaultPollingInterval
+	if authorization.Interval > 0 {
+		interval = time.Duration(authorization.Interval) * time.Second
+	}
+	deadline := time.Now().Add(time.Duration(authorization.ExpiresIn) * time.Second)
+	for {
+		if err = p.sleep(ctx, interval); err != nil {
+			return nil, err
+		}
+		token, tokenError, err := p.requestToken(ctx, discovered.TokenEndpoint, url.Values{
+			"grant_type":  {deviceCodeGrantType},
+			"device_code": {authorization.DeviceCode},
+			"client_id":   {p.clientID},
+		})
+		if err != nil {
+			return nil, err
+		}
+		switch tokenError {
+		case "":
+			return token, nil
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * time.Second
+		case "access_denied":
+			return nil, errors.New("authorization was denied")
+		case "expired_token":
+			return nil, errors.New("user code has expired, run login again")
+		default:
+			return nil, errors.New("authorization failed: " + tokenError)
+		}
+		if authorization.ExpiresIn > 0 && time.Now().After(deadline) {
+			return nil, errors.New("user code has expired, run login again")
+		}
+	}
+}
+
+// Refresh method exchanges the refresh token for the new tokens. The refresh token is kept if no new one is issued.
+func (p defaultProvider) Refresh(ctx context.Context, refreshToken string) (*Token, error) {
+	if refreshToken == "" {
+		return nil, errors.New("refresh token is not available, run login again")
+	}
+	discovered, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	token, tokenError, err := p.requestToken(ctx, discovered.TokenEndpoint, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+		"client_id":     {p.clientID},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if tokenError != "" {
+		return nil, errors.New("token can not be refreshed: " + tokenError + ", run login again")
+	}
+	if token.RefreshToken == "" {
+		token.RefreshToken = refreshToken
+	}
+	return token, nil
+}
+
+// discover reads the endpoints from the OpenID Connect discovery document of the issuer.
+func (p defaultProvider) discover(ctx context.Context) (*endpoints, error) {
+	response, err := p.client.DoRequest(ctx, http.MethodGet, p.issuer+"/.well-known/openid-configuration", nil, nil, nil, "", "")
+	if err != nil {
+		return nil, err
+	}
+	body, err := readBody(p.issuer, response)
+	if err != nil {
+		return nil, err
+	}
+	var discovered endpoints
+	if err = json.Unmarshal(body, &discovered); err != nil {
+		return nil, err
+	}
+	if discovered.TokenEndpoint == "" {
+		return nil, errors.New(p.issuer + " does not provide the token endpoint")
+	}
+	return &discovered, nil
+}
+
+// requestToken posts the grant to the token endpoint, returning either the token or the OAuth2 error code.
+func (p defaultProvider) requestToken(ctx context.Context, endpoint string, form url.Values) (*Token, string, error) {
+	response, err := p.post(ctx, endpoint, form)
+	if err != nil {
+		return nil, "", err
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	var parsed tokenResponse
+	if err = json.Unmarshal(body, &parsed); err != nil {
+		return nil, "", fmt.Errorf("token endpoint responded with %v: %v", response.StatusCode, string(body))
+	}
+	if parsed.Error != "" {
+		return nil, parsed.Error, nil
+	}
+	if response.StatusCode != http.StatusOK || parsed.AccessToken == "" {
+		return nil, "", fmt.Errorf("token endpoint responded with %v: %v", response.StatusCode, string(body))
+	}
+	token := Token{AccessToken: parsed.AccessToken, RefreshToken: parsed.RefreshToken, TokenType: parsed.TokenType}
+	if parsed.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(parsed.ExpiresIn) * time.Second)
+	}
+	return &token, "", nil
+}
+
+func (p defaultProvider) post(ctx context.Context, endpoint string, form url.Values) (*http.Response, error) {
+	return p.client.DoRequest(ctx, http.MethodPost,
+		endpoint,
+		strings.NewReader(form.Encode()),
+		map[string]string{"Content-Type": "application/x-www-form-urlencoded", "Accept": "application/json"},
+		nil,
+		"",
+		"")
+}
+
+// readBody reads the body of the successful response, or turns the unsuccessful one into the error.
+func readBody(location string, response *http.Response) ([]byte, error) {
+	if err := requests.CheckResponse(response); err != nil {
+		return nil, fmt.Errorf("%v: %w", location, err)
+	}
+	defer response.Body.Close()
+	return ioutil.ReadAll(response.Body)
+}
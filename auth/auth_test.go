@@ -0,0 +1,189 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mockIssuer is a minimal OpenID Connect issuer supporting the device authorization and the refresh token grants.
+type mockIssuer struct {
+	server       *httptest.Server
+	pendingPolls int
+	polls        int
+	denied       bool
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	issuer := &mockIssuer{pendingPolls: 2}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"issuer":                        issuer.server.URL,
+			"device_authorization_endpoint": issuer.server.URL + "/device",
+			"token_endpoint":                issuer.server.URL + "/token",
+		})
+	})
+	mux.HandleFunc("/device", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.FormValue("client_id") != "client" || r.FormValue("scope") != "openid offline_access" {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "invalid_request"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"device_code":      "device-code",
+			"user_code":        "ABCD-EFGH",
+			"verification_uri": issuer.server.URL + "/activate",
+			"expires_in":       600,
+			"interval":         1,
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("client_id") != "client" {
+			writeJSON(w, http.StatusUnauthorized, map[string]interface{}{"error": "invalid_client"})
+			return
+		}
+		switch r.FormValue("grant_type") {
+		case deviceCodeGrantType:
+			issuer.polls++
+			if r.FormValue("device_code") != "device-code" {
+				writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "invalid_grant"})
+			} else if issuer.denied {
+				writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "access_denied"})
+			} else if issuer.polls <= issuer.pendingPolls {
+				writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "authorization_pending"})
+			} else {
+				writeJSON(w, http.StatusOK, map[string]interface{}{
+					"access_token":  "access-1",
+					"refresh_token": "refresh-1",
+					"token_type":    "Bearer",
+					"expires_in":    3600,
+				})
+			}
+		case "refresh_token":
+			if r.FormValue("refresh_token") != "refresh-1" {
+				writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "invalid_grant"})
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{"access_token": "access-2", "expires_in": 3600})
+		default:
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "unsupported_grant_type"})
+		}
+	})
+	issuer.server = httptest.NewServer(mux)
+	t.Cleanup(issuer.server.Close)
+	return issuer
+}
+
+func writeJSON(w http.ResponseWriter, status int, body map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func newTestProvider(t *testing.T, issuer *mockIssuer, intervals *[]time.Duration) Provider {
+	provider, err := NewProvider(nil, issuer.server.URL+"/", "client", "openid offline_access")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testProvider := provider.(defaultProvider)
+	testProvider.sleep = func(_ context.Context, duration time.Duration) error {
+		*intervals = append(*intervals, duration)
+		return nil
+	}
+	return testProvider
+}
+
+func TestNewProviderNoClientID(t *testing.T) {
+	if _, err := NewProvider(nil, "https://issuer.example", "", ""); err == nil {
+		t.Error()
+	}
+}
+
+func TestLogin(t *testing.T) {
+	issuer := newMockIssuer(t)
+	var intervals []time.Duration
+	var notified DeviceAuthorization
+	token, err := newTestProvider(t, issuer, &intervals).Login(context.Background(), func(authorization DeviceAuthorization) {
+		notified = authorization
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if notified.UserCode != "ABCD-EFGH" || !strings.HasSuffix(notified.VerificationURI, "/activate") {
+		t.Error(notified)
+	}
+	if token.AccessToken != "access-1" || token.RefreshToken != "refresh-1" || !token.Valid(time.Minute) {
+		t.Error(token)
+	}
+	if len(intervals) != 3 || intervals[0] != time.Second {
+		t.Error(intervals)
+	}
+}
+
+func TestLoginDenied(t *testing.T) {
+	issuer := newMockIssuer(t)
+	issuer.denied = true
+	var intervals []time.Duration
+	_, err := newTestProvider(t, issuer, &intervals).Login(context.Background(), func(DeviceAuthorization) {})
+	if err == nil || !strings.Contains(err.Error(), "denied") {
+		t.Error(err)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	issuer := newMockIssuer(t)
+	var intervals []time.Duration
+	provider := newTestProvider(t, issuer, &intervals)
+	token, err := provider.Refresh(context.Background(), "refresh-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "access-2" || token.RefreshToken != "refresh-1" {
+		t.Error(token)
+	}
+	if _, err = provider.Refresh(context.Background(), "revoked"); err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Error(err)
+	}
+}
+
+func TestTokenValid(t *testing.T) {
+	if (Token{}).Valid(0) || !(Token{AccessToken: "a"}).Valid(time.Hour) {
+		t.Error()
+	}
+	if (Token{AccessToken: "a", Expiry: time.Now().Add(30 * time.Second)}).Valid(time.Minute) {
+		t.Error()
+	}
+}
+
+func TestTokenCache(t *testing.T) {
+	cache := NewTokenCache(filepath.Join(t.TempDir(), "lega-commander", "tokens.json"))
+	token, err := cache.Load("default")
+	if err != nil || token != nil {
+		t.Error(token, err)
+	}
+	expiry := time.Now().Add(time.Hour).Round(time.Second)
+	if err = cache.Store("default", Token{AccessToken: "a", Expiry: expiry}); err != nil {
+		t.Fatal(err)
+	}
+	if err = cache.Store("staging", Token{AccessToken: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	token, err = cache.Load("default")
+	if err != nil || token.AccessToken != "a" || !token.Expiry.Equal(expiry) {
+		t.Error(token, err)
+	}
+	if err = cache.Delete("default"); err != nil {
+		t.Fatal(err)
+	}
+	if token, err = cache.Load("default"); err != nil || token != nil {
+		t.Error(token, err)
+	}
+	if token, err = cache.Load("staging"); err != nil || token.AccessToken != "b" {
+		t.Error(token, err)
+	}
+}
@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// TokenCache structure represents the file keeping the tokens of the users between the runs, one per profile.
+type TokenCache struct {
+	path  string
+	mutex sync.Mutex
+}
+
+// NewTokenCache constructs TokenCache kept in the file.
+func NewTokenCache(path string) *TokenCache {
+	return &TokenCache{path: path}
+}
+
+// Load method returns the cached token of the key, nil if there is none.
+func (tc *TokenCache) Load(key string) (*Token, error) {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	tokens, err := tc.read()
+	if err != nil {
+		return nil, err
+	}
+	token, ok := tokens[key]
+	if !ok {
+		return nil, nil
+	}
+	return &token, nil
+}
+
+// Store method caches the token under the key, replacing the previous one.
+func (tc *TokenCache) Store(key string, token Token) error {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	tokens, err := tc.read()
+	if err != nil {
+		return err
+	}
+	tokens[key] = token
+	return tc.write(tokens)
+}
+
+// Delete method removes the token of the key from the cache.
+func (tc *TokenCache) Delete(key string) error {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	tokens, err := tc.read()
+	if err != nil {
+		return err
+	}
+	if _, ok := tokens[key]; !ok {
+		return nil
+	}
+	delete(tokens, key)
+	return tc.write(tokens)
+}
+
+// read reads all the cached tokens; a missing file is the same as an empty one.
+func (tc *TokenCache) read() (map[string]Token, error) {
+	tokens := map[string]Token{}
+	content, err := os.ReadFile(tc.path)
+	if os.IsNotExist(err) {
+		return tokens, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(content, &tokens); err != nil {
+		return nil, fmt.Errorf("%v: %v", tc.path, err)
+	}
+	return tokens, nil
+}
+
+func (tc *TokenCache) write(tokens map[string]Token) error {
+	content, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(tc.path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(tc.path, content, 0600)
+}
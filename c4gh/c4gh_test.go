@@ -0,0 +1,371 @@
+package c4gh
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/neicnordic/crypt4gh/keys"
+	"github.com/neicnordic/crypt4gh/model/headers"
+	crypt4gh "github.com/neicnordic/crypt4gh/streaming"
+)
+
+func TestFingerprint(t *testing.T) {
+	publicKey, _, err := keys.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPublicKey, _, err := keys.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := Fingerprint(publicKey)
+	if !strings.HasPrefix(fingerprint, "SHA256:") || fingerprint != Fingerprint(publicKey) {
+		t.Error(fingerprint)
+	}
+	if fingerprint == Fingerprint(otherPublicKey) {
+		t.Error()
+	}
+}
+
+func TestReadPublicKey(t *testing.T) {
+	publicKey, _, err := keys.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "key.pub")
+	keyFile, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = keys.WriteCrypt4GHX25519PublicKey(keyFile, publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = keyFile.Close()
+	readKey, err := ReadPublicKey(path)
+	if err != nil || *readKey != publicKey {
+		t.Error(err)
+	}
+	_, err = ReadPublicKey(filepath.Join(t.TempDir(), "missing.pub"))
+	if err == nil {
+		t.Error()
+	}
+}
+
+func TestReadPrivateKey(t *testing.T) {
+	_, privateKey, err := keys.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "key.sec")
+	keyFile, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = keys.WriteCrypt4GHX25519PrivateKey(keyFile, privateKey, []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = keyFile.Close()
+	_ = os.Setenv("C4GH_PASSPHRASE", "passphrase")
+	defer os.Unsetenv("C4GH_PASSPHRASE")
+	readKey, err := ReadPrivateKey(path)
+	if err != nil || *readKey != privateKey {
+		t.Error(err)
+	}
+	_ = os.Setenv("C4GH_PASSPHRASE", "wrong")
+	_, err = ReadPrivateKey(path)
+	if err == nil {
+		t.Error()
+	}
+}
+
+func TestGenerateKey(t *testing.T) {
+	directory := filepath.Join(t.TempDir(), "keys")
+	key, err := GenerateKey(directory, "mine", []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := os.Stat(key.PrivateKeyPath)
+	if err != nil || stat.Mode().Perm() != 0600 {
+		t.Error(err)
+	}
+	_ = os.Setenv("C4GH_PASSPHRASE", "passphrase")
+	defer os.Unsetenv("C4GH_PASSPHRASE")
+	privateKey, err := ReadPrivateKey(key.PrivateKeyPath)
+	if err != nil || keys.DerivePublicKey(*privateKey) != key.PublicKey {
+		t.Error(err)
+	}
+	_, err = GenerateKey(directory, "mine", []byte("passphrase"))
+	if err == nil || !strings.Contains(err.Error(), "exists already") {
+		t.Error(err)
+	}
+	for _, name := range []string{"", ".hidden", "../outside"} {
+		if _, err = GenerateKey(directory, name, []byte("passphrase")); err == nil {
+			t.Error(name)
+		}
+	}
+	if _, err = GenerateKey(directory, "unlocked", nil); err == nil {
+		t.Error()
+	}
+	if err = os.Symlink(filepath.Join(directory, "missing"), filepath.Join(directory, "broken.pub")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = GenerateKey(directory, "broken", []byte("passphrase")); err == nil {
+		t.Error()
+	}
+	if _, err = os.Stat(filepath.Join(directory, "broken.sec")); !os.IsNotExist(err) {
+		t.Error(err)
+	}
+	publicKey, err := ReadKeyPublicPart(key.PrivateKeyPath)
+	if err != nil || *publicKey != key.PublicKey {
+		t.Error(err)
+	}
+	publicKey, err = ReadKeyPublicPart(key.PublicKeyPath)
+	if err != nil || *publicKey != key.PublicKey {
+		t.Error(err)
+	}
+	passphrase, err := NewPassphrase("new")
+	if err != nil || string(passphrase) != "passphrase" {
+		t.Error(err)
+	}
+}
+
+func TestListKeys(t *testing.T) {
+	directory := t.TempDir()
+	keyList, err := ListKeys(directory)
+	if err != nil || len(keyList) != 0 {
+		t.Error(keyList, err)
+	}
+	for _, name := range []string{"second", "first"} {
+		if _, err = GenerateKey(directory, name, []byte("passphrase")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keyList, err = ListKeys(directory)
+	if err != nil || len(keyList) != 2 || keyList[0].Name != "first" || keyList[1].Name != "second" {
+		t.Error(keyList, err)
+	}
+	key, err := GetKey(directory, "second")
+	if err != nil || key.PublicKey != keyList[1].PublicKey {
+		t.Error(err)
+	}
+	if _, err = GetKey(directory, "third"); err == nil || !strings.Contains(err.Error(), "is not found") {
+		t.Error(err)
+	}
+}
+
+func TestKeyPath(t *testing.T) {
+	directory := t.TempDir()
+	if path := PublicKeyPath(directory, "mine"); path != filepath.Join(directory, "mine.pub") {
+		t.Error(path)
+	}
+	if path := PrivateKeyPath(directory, "mine"); path != filepath.Join(directory, "mine.sec") {
+		t.Error(path)
+	}
+	if path := PublicKeyPath(directory, "keys/mine.pub"); path != "keys/mine.pub" {
+		t.Error(path)
+	}
+	if path := PrivateKeyPath(directory, "c4gh_test.go"); path != "c4gh_test.go" {
+		t.Error(path)
+	}
+}
+
+func TestInspectHeader(t *testing.T) {
+	writerPublicKey, writerPrivateKey, err := keys.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipientPublicKey, recipientPrivateKey, err := keys.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPublicKey, otherPrivateKey, err := keys.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer := bytes.Buffer{}
+	dataEditList := headers.DataEditListHeaderPacket{
+		PacketType:    headers.PacketType{PacketType: headers.DataEditList},
+		NumberLengths: 2,
+		Lengths:       []uint64{10, 100},
+	}
+	writer, err := crypt4gh.NewCrypt4GHWriter(&buffer, writerPrivateKey, [][32]byte{recipientPublicKey, otherPublicKey}, &dataEditList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = writer.Write([]byte("Hello, World!"))
+	_ = writer.Close()
+
+	header, err := InspectHeader(bytes.NewReader(buffer.Bytes()), recipientPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Version != 1 || len(header.Packets) != 4 || header.Size >= buffer.Len() {
+		t.Fatal(header)
+	}
+	for i, packet := range header.Packets {
+		if packet.WriterPublicKey != writerPublicKey || packet.EncryptionMethod != headers.X25519ChaCha20IETFPoly1305 {
+			t.Error(packet)
+		}
+		if packet.Decrypted() != (i < 2) {
+			t.Error(i, packet.Decrypted())
+		}
+	}
+	if *header.Packets[0].Recipient != recipientPublicKey || header.Packets[0].Type != headers.DataEncryptionParameters {
+		t.Error(header.Packets[0])
+	}
+	if header.Packets[1].Type != headers.DataEditList || len(header.Packets[1].DataEditList) != 2 ||
+		header.Packets[1].DataEditList[1] != 100 {
+		t.Error(header.Packets[1])
+	}
+
+	header, err = InspectHeader(bytes.NewReader(buffer.Bytes()), recipientPrivateKey, otherPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *header.Packets[2].Recipient != otherPublicKey || *header.Packets[3].Recipient != otherPublicKey {
+		t.Error(header.Packets[2], header.Packets[3])
+	}
+}
+
+func TestIsAddressedTo(t *testing.T) {
+	_, writerPrivateKey, err := keys.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipientPublicKey, _, err := keys.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPublicKey, otherPrivateKey, err := keys.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer := bytes.Buffer{}
+	writer, err := crypt4gh.NewCrypt4GHWriter(&buffer, writerPrivateKey, [][32]byte{recipientPublicKey}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = writer.Close()
+	header, err := InspectHeader(bytes.NewReader(buffer.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addressed, err := header.IsAddressedTo(recipientPublicKey, otherPrivateKey, writerPrivateKey)
+	if err != nil || !addressed {
+		t.Error(addressed, err)
+	}
+	addressed, err = header.IsAddressedTo(otherPublicKey, writerPrivateKey)
+	if err != nil || addressed {
+		t.Error(addressed, err)
+	}
+	_, err = header.IsAddressedTo(recipientPublicKey, otherPrivateKey)
+	if _, ok := err.(*UnknownWriterError); !ok {
+		t.Error(err)
+	}
+	_, err = header.IsAddressedTo(recipientPublicKey)
+	if _, ok := err.(*UnknownWriterError); !ok {
+		t.Error(err)
+	}
+}
+
+func TestReencrypt(t *testing.T) {
+	publicKey, privateKey, err := keys.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipientPublicKey, recipientPrivateKey, err := keys.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := bytes.Repeat([]byte("lega"), 50000)
+	encrypted := bytes.Buffer{}
+	writer, err := crypt4gh.NewCrypt4GHWriterWithoutPrivateKey(&encrypted, [][32]byte{publicKey}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = writer.Write(plaintext)
+	_ = writer.Close()
+	header, err := InspectHeader(bytes.NewReader(encrypted.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reencrypted := bytes.Buffer{}
+	written, err := Reencrypt(&reencrypted, bytes.NewReader(encrypted.Bytes()), privateKey, [][32]byte{recipientPublicKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != int64(reencrypted.Len()) {
+		t.Error(written, reencrypted.Len())
+	}
+	newHeader, err := InspectHeader(bytes.NewReader(reencrypted.Bytes()), recipientPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(encrypted.Bytes()[header.Size:], reencrypted.Bytes()[newHeader.Size:]) {
+		t.Error("data segments are changed")
+	}
+	reader, err := crypt4gh.NewCrypt4GHReader(bytes.NewReader(reencrypted.Bytes()), recipientPrivateKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := io.ReadAll(reader)
+	if err != nil || !bytes.Equal(decrypted, plaintext) {
+		t.Error(err)
+	}
+	_, err = Reencrypt(io.Discard, bytes.NewReader(encrypted.Bytes()), recipientPrivateKey, [][32]byte{recipientPublicKey})
+	if err == nil {
+		t.Error()
+	}
+}
+
+func TestReencryptFile(t *testing.T) {
+	_, privateKey, err := keys.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipientPublicKey, _, err := keys.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	destination := filepath.Join(t.TempDir(), "test.c4gh")
+	err = ReencryptFile("../test/test.enc", destination, privateKey, [][32]byte{recipientPublicKey})
+	if err == nil || !strings.Contains(err.Error(), "header can not be decrypted") {
+		t.Error(err)
+	}
+	if _, err = os.Stat(destination); !os.IsNotExist(err) {
+		t.Error("incomplete file is left behind")
+	}
+	_ = os.WriteFile(destination, nil, 0600)
+	err = ReencryptFile("../test/test.enc", destination, privateKey, [][32]byte{recipientPublicKey})
+	if err == nil || !strings.Contains(err.Error(), "exists locally") {
+		t.Error(err)
+	}
+}
+
+func TestInspectHeaderNotCrypt4GH(t *testing.T) {
+	_, err := InspectHeader(strings.NewReader("plain text, not a Crypt4GH file"))
+	if err == nil {
+		t.Error()
+	}
+}
+
+func TestInspectFile(t *testing.T) {
+	header, err := InspectFile("../test/test.enc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(header.Packets) == 0 || header.Packets[0].Decrypted() {
+		t.Error(header)
+	}
+	_, err = InspectFile("../test/files/sample.txt")
+	if err == nil || !strings.HasPrefix(err.Error(), "../test/files/sample.txt: ") {
+		t.Error(err)
+	}
+}
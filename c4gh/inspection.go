@@ -0,0 +1,116 @@
+package c4gh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/neicnordic/crypt4gh/keys"
+	"github.com/neicnordic/crypt4gh/model/headers"
+)
+
+// Header structure describes the header of a Crypt4GH file.
+type Header struct {
+	Version uint32
+	Size    int
+	Packets []Packet
+}
+
+// Packet structure describes a single header packet. Only the fields before Recipient are stored in plaintext, the
+// rest is known only if the packet could be decrypted with one of the private keys given to InspectHeader.
+type Packet struct {
+	Length           uint32
+	EncryptionMethod headers.HeaderEncryptionMethod
+	WriterPublicKey  [32]byte
+	Recipient        *[32]byte
+	Type             headers.HeaderPacketType
+	// DataEncryptionMethod is set for data encryption parameters packets.
+	DataEncryptionMethod headers.DataEncryptionMethod
+	// DataEditList is set for data edit list packets.
+	DataEditList []uint64
+	// payload holds the writer public key, the nonce and the encrypted content of the packet.
+	payload []byte
+}
+
+// Decrypted method tells whether the packet was decrypted, i.e. whether its recipient has been discovered.
+func (p Packet) Decrypted() bool {
+	return p.Recipient != nil
+}
+
+// InspectFile reads the header of the local Crypt4GH file, see InspectHeader.
+func InspectFile(path string, privateKeys ...[32]byte) (*Header, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	header, err := InspectHeader(file, privateKeys...)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	return header, nil
+}
+
+// InspectHeader reads the Crypt4GH header from the reader. Every header packet is tried with each of the private
+// keys, and the public key of the first one that decrypts it is recorded as the recipient of the packet.
+func InspectHeader(reader io.Reader, privateKeys ...[32]byte) (*Header, error) {
+	raw, err := headers.ReadHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	header := Header{Size: len(raw)}
+	buffer := bytes.NewReader(raw[len(headers.MagicNumber):])
+	var packetCount uint32
+	if err = binary.Read(buffer, binary.LittleEndian, &header.Version); err != nil {
+		return nil, err
+	}
+	if err = binary.Read(buffer, binary.LittleEndian, &packetCount); err != nil {
+		return nil, err
+	}
+	for i := uint32(0); i < packetCount; i++ {
+		var packet Packet
+		if err = binary.Read(buffer, binary.LittleEndian, &packet.Length); err != nil {
+			return nil, err
+		}
+		// packet length includes the length field itself, ReadHeader has already checked that it is all there
+		if packet.Length < 4+4+32 {
+			return nil, fmt.Errorf("header packet %d is too short: %d bytes", i+1, packet.Length)
+		}
+		content := make([]byte, packet.Length-4)
+		if _, err = io.ReadFull(buffer, content); err != nil {
+			return nil, err
+		}
+		packet.EncryptionMethod = headers.HeaderEncryptionMethod(binary.LittleEndian.Uint32(content))
+		copy(packet.WriterPublicKey[:], content[4:])
+		packet.payload = content[4:]
+		packetBytes := append(binary.LittleEndian.AppendUint32(nil, packet.Length), content...)
+		for _, privateKey := range privateKeys {
+			if decryptPacket(&packet, packetBytes, privateKey) {
+				break
+			}
+		}
+		header.Packets = append(header.Packets, packet)
+	}
+	return &header, nil
+}
+
+// decryptPacket tries to decrypt the packet with the private key, filling in the encrypted fields on success.
+func decryptPacket(packet *Packet, packetBytes []byte, privateKey [32]byte) bool {
+	headerPacket, err := headers.NewHeaderPacket(bytes.NewReader(packetBytes), privateKey)
+	if err != nil {
+		return false
+	}
+	recipient := keys.DerivePublicKey(privateKey)
+	packet.Recipient = &recipient
+	switch encryptedPacket := headerPacket.EncryptedHeaderPacket.(type) {
+	case headers.DataEncryptionParametersHeaderPacket:
+		packet.Type = encryptedPacket.GetPacketType()
+		packet.DataEncryptionMethod = encryptedPacket.DataEncryptionMethod
+	case headers.DataEditListHeaderPacket:
+		packet.Type = encryptedPacket.GetPacketType()
+		packet.DataEditList = encryptedPacket.Lengths
+	}
+	return true
+}
@@ -0,0 +1,104 @@
+// Package c4gh contains helpers to read, inspect and manipulate Crypt4GH keys and headers of local files.
+package c4gh
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/neicnordic/crypt4gh/keys"
+	"golang.org/x/term"
+)
+
+// Fingerprint returns the SHA-256 fingerprint of the X25519 key in the form of "SHA256:<base64 digest>".
+func Fingerprint(key [32]byte) string {
+	digest := sha256.Sum256(key[:])
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(digest[:])
+}
+
+// ReadPublicKey reads Crypt4GH or OpenSSL X25519 public key from the file.
+func ReadPublicKey(path string) (*[32]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	publicKey, err := keys.ReadPublicKey(file)
+	if err != nil {
+		return nil, errors.New(path + ": " + err.Error())
+	}
+	return &publicKey, nil
+}
+
+// ReadKeyPublicPart reads the public key from the public key file, or derives it from the private key file.
+func ReadKeyPublicPart(path string) (*[32]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Contains(content, []byte("PRIVATE KEY-----")) {
+		return ReadPublicKey(path)
+	}
+	privateKey, err := ReadPrivateKey(path)
+	if err != nil {
+		return nil, err
+	}
+	publicKey := keys.DerivePublicKey(*privateKey)
+	return &publicKey, nil
+}
+
+// ReadPrivateKey reads Crypt4GH or OpenSSL X25519 private key from the file. The passphrase of a locked key is taken
+// from C4GH_PASSPHRASE environment variable or, if it is not set, prompted for.
+func ReadPrivateKey(path string) (*[32]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, err := keys.ReadPrivateKey(bytes.NewReader(content), nil)
+	if err == nil {
+		return &privateKey, nil
+	}
+	passphrase, ok := os.LookupEnv("C4GH_PASSPHRASE")
+	if !ok {
+		passphrase, err = readPassphrase("Enter the passphrase to unlock " + path + ": ")
+		if err != nil {
+			return nil, err
+		}
+	}
+	privateKey, err = keys.ReadPrivateKey(bytes.NewReader(content), []byte(passphrase))
+	if err != nil {
+		return nil, errors.New(path + ": bad passphrase or unsupported key: " + err.Error())
+	}
+	return &privateKey, nil
+}
+
+// NewPassphrase returns the passphrase to lock a new private key with, taken from C4GH_PASSPHRASE environment
+// variable or, if it is not set, prompted for twice.
+func NewPassphrase(name string) ([]byte, error) {
+	if passphrase, ok := os.LookupEnv("C4GH_PASSPHRASE"); ok {
+		return []byte(passphrase), nil
+	}
+	passphrase, err := readPassphrase("Enter the passphrase to lock " + name + ": ")
+	if err != nil {
+		return nil, err
+	}
+	confirmation, err := readPassphrase("Enter the same passphrase again: ")
+	if err != nil {
+		return nil, err
+	}
+	if passphrase != confirmation {
+		return nil, errors.New("passphrases do not match")
+	}
+	return []byte(passphrase), nil
+}
+
+// readPassphrase prompts for the passphrase without echoing it.
+func readPassphrase(prompt string) (string, error) {
+	fmt.Print(prompt)
+	passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	return string(passphrase), err
+}
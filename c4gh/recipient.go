@@ -0,0 +1,84 @@
+package c4gh
+
+import (
+	"encoding/binary"
+	"strings"
+
+	"github.com/neicnordic/crypt4gh/keys"
+	"github.com/neicnordic/crypt4gh/model/headers"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// UnknownWriterError is returned when the recipient of the header can not be checked, because none of the given
+// private keys is the one the header packets were written with.
+type UnknownWriterError struct {
+	WriterPublicKeys [][32]byte
+}
+
+// Error returns the fingerprints of the keys the header packets were written with.
+func (e *UnknownWriterError) Error() string {
+	fingerprints := make([]string, len(e.WriterPublicKeys))
+	for i, writerPublicKey := range e.WriterPublicKeys {
+		fingerprints[i] = Fingerprint(writerPublicKey)
+	}
+	return "header is written with the key " + strings.Join(fingerprints, ", ") + ", no private key of which is given"
+}
+
+// IsAddressedTo method checks whether the header holds data encryption parameters for the recipient public key.
+// Only the private keys of the recipient or of the writer can open a packet, so the latter has to be given in order
+// to check a recipient whose private key is not at hand.
+func (h Header) IsAddressedTo(recipient [32]byte, writerPrivateKeys ...[32]byte) (bool, error) {
+	var writers [][32]byte
+	checked := false
+	for _, packet := range h.Packets {
+		if !containsKey(writers, packet.WriterPublicKey) {
+			writers = append(writers, packet.WriterPublicKey)
+		}
+		for _, writerPrivateKey := range writerPrivateKeys {
+			if keys.DerivePublicKey(writerPrivateKey) != packet.WriterPublicKey {
+				continue
+			}
+			checked = true
+			packetType, ok := openPacket(packet.payload, writerPrivateKey, recipient)
+			if ok && packetType == headers.DataEncryptionParameters {
+				return true, nil
+			}
+		}
+	}
+	if !checked {
+		return false, &UnknownWriterError{WriterPublicKeys: writers}
+	}
+	return false, nil
+}
+
+// openPacket decrypts the packet payload on the writer side and returns the type of the packet, if the packet was
+// written for the recipient.
+func openPacket(payload []byte, writerPrivateKey, recipient [32]byte) (headers.HeaderPacketType, bool) {
+	if len(payload) < chacha20poly1305.KeySize+chacha20poly1305.NonceSize {
+		return 0, false
+	}
+	sharedKey, err := keys.GenerateWriterSharedKey(writerPrivateKey, recipient)
+	if err != nil {
+		return 0, false
+	}
+	aead, err := chacha20poly1305.New(*sharedKey)
+	if err != nil {
+		return 0, false
+	}
+	nonce := payload[chacha20poly1305.KeySize : chacha20poly1305.KeySize+chacha20poly1305.NonceSize]
+	content, err := aead.Open(nil, nonce, payload[chacha20poly1305.KeySize+chacha20poly1305.NonceSize:], nil)
+	if err != nil || len(content) < 4 {
+		return 0, false
+	}
+	return headers.HeaderPacketType(binary.LittleEndian.Uint32(content)), true
+}
+
+// containsKey tells whether the key is in the list.
+func containsKey(list [][32]byte, key [32]byte) bool {
+	for _, listed := range list {
+		if listed == key {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package c4gh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/neicnordic/crypt4gh/model/headers"
+)
+
+// Reencrypt copies the Crypt4GH file from the reader to the writer, replacing its header with one encrypted for the
+// recipients. The header is decrypted with the private key, while the data segments are copied untouched. The number
+// of bytes written is returned.
+func Reencrypt(writer io.Writer, reader io.Reader, privateKey [32]byte, recipients [][32]byte) (int64, error) {
+	if len(recipients) == 0 {
+		return 0, errors.New("no recipient to encrypt the header for")
+	}
+	header, err := headers.ReadHeader(reader)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = headers.NewHeader(bytes.NewReader(header), privateKey); err != nil {
+		return 0, errors.New("header can not be decrypted with the given key: " + err.Error())
+	}
+	newHeader, err := headers.ReEncryptHeader(header, privateKey, recipients)
+	if err != nil {
+		return 0, err
+	}
+	written, err := writer.Write(newHeader)
+	if err != nil {
+		return int64(written), err
+	}
+	copied, err := io.Copy(writer, reader)
+	return int64(written) + copied, err
+}
+
+// ReencryptFile writes the copy of the local Crypt4GH file re-encrypted for the recipients to the destination, see
+// Reencrypt. An existing destination file is not overwritten, and an incomplete one is removed.
+func ReencryptFile(source, destination string, privateKey [32]byte, recipients [][32]byte) error {
+	sourceFile, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+	destinationFile, err := os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return errors.New("File " + destination + " exists locally, aborting.")
+		}
+		return err
+	}
+	_, err = Reencrypt(destinationFile, sourceFile, privateKey, recipients)
+	if closeErr := destinationFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(destination)
+		return fmt.Errorf("%v: %w", source, err)
+	}
+	return nil
+}
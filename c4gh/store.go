@@ -0,0 +1,148 @@
+package c4gh
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/neicnordic/crypt4gh/keys"
+)
+
+const (
+	publicKeyExtension  = ".pub"
+	privateKeyExtension = ".sec"
+)
+
+// Key structure represents a named key pair kept in the key directory.
+type Key struct {
+	Name           string
+	PublicKey      [32]byte
+	PublicKeyPath  string
+	PrivateKeyPath string
+}
+
+// GenerateKey generates a new X25519 key pair and stores it in the key directory under the name, as NAME.pub and
+// NAME.sec files in Crypt4GH format. The private key is locked with the passphrase. Neither file is left behind if
+// the pair can not be stored.
+func GenerateKey(directory, name string, passphrase []byte) (*Key, error) {
+	if err := checkKeyName(name); err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("private key has to be protected with a passphrase")
+	}
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, err
+	}
+	key := newKey(directory, name)
+	for _, path := range []string{key.PublicKeyPath, key.PrivateKeyPath} {
+		if _, err := os.Stat(path); err == nil {
+			return nil, errors.New("Key " + path + " exists already, aborting.")
+		}
+	}
+	publicKey, privateKey, err := keys.GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	privateKeyFile, err := os.OpenFile(key.PrivateKeyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = keys.WriteCrypt4GHX25519PrivateKey(privateKeyFile, privateKey, passphrase)
+	if closeErr := privateKeyFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(key.PrivateKeyPath)
+		return nil, err
+	}
+	publicKeyFile, err := os.OpenFile(key.PublicKeyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		_ = os.Remove(key.PrivateKeyPath)
+		return nil, err
+	}
+	err = keys.WriteCrypt4GHX25519PublicKey(publicKeyFile, publicKey)
+	if closeErr := publicKeyFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(key.PublicKeyPath)
+		_ = os.Remove(key.PrivateKeyPath)
+		return nil, err
+	}
+	key.PublicKey = publicKey
+	return &key, nil
+}
+
+// GetKey reads the public key of the named key pair from the key directory.
+func GetKey(directory, name string) (*Key, error) {
+	if err := checkKeyName(name); err != nil {
+		return nil, err
+	}
+	key := newKey(directory, name)
+	publicKey, err := ReadPublicKey(key.PublicKeyPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.New("Key " + name + " is not found in " + directory)
+		}
+		return nil, err
+	}
+	key.PublicKey = *publicKey
+	return &key, nil
+}
+
+// ListKeys lists the key pairs kept in the key directory, sorted by name.
+func ListKeys(directory string) ([]Key, error) {
+	paths, err := filepath.Glob(filepath.Join(directory, "*"+publicKeyExtension))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	keyList := make([]Key, 0, len(paths))
+	for _, path := range paths {
+		key, err := GetKey(directory, strings.TrimSuffix(filepath.Base(path), publicKeyExtension))
+		if err != nil {
+			return nil, err
+		}
+		keyList = append(keyList, *key)
+	}
+	return keyList, nil
+}
+
+// PublicKeyPath returns the path of the public key referenced either by its path or by its name in the key directory.
+func PublicKeyPath(directory, reference string) string {
+	return keyPath(directory, reference, publicKeyExtension)
+}
+
+// PrivateKeyPath returns the path of the private key referenced either by its path or by its name in the key
+// directory.
+func PrivateKeyPath(directory, reference string) string {
+	return keyPath(directory, reference, privateKeyExtension)
+}
+
+// keyPath prefers the existing file the reference points to over the key of that name in the key directory.
+func keyPath(directory, reference, extension string) string {
+	if _, err := os.Stat(reference); err == nil || checkKeyName(reference) != nil {
+		return reference
+	}
+	return filepath.Join(directory, reference+extension)
+}
+
+// newKey constructs the Key of the given name, without the public key read yet.
+func newKey(directory, name string) Key {
+	return Key{
+		Name:           name,
+		PublicKeyPath:  filepath.Join(directory, name+publicKeyExtension),
+		PrivateKeyPath: filepath.Join(directory, name+privateKeyExtension),
+	}
+}
+
+// checkKeyName makes sure the name can be used as a file name in the key directory.
+func checkKeyName(name string) error {
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) {
+		return errors.New("Key name " + name + " is not valid, it can not be empty, start with a dot or contain slashes")
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ package conf
 import (
 	"log"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -17,6 +18,14 @@ const defaultTSDService = "ega"
 const defaultTSDProject = "p969"
 const defaultTSDfileAPIbaseURL = "https://api.tsd.usit.no"
 const defaultChunkSize = 50
+const defaultReadAheadChunks = 1
+const defaultHTTPAttempts = 4
+const defaultOIDCIssuer = "https://login.elixir-czech.org/oidc"
+const defaultOIDCScope = "openid offline_access"
+
+// defaultProfileKey is the key the data of the user, such as the cached tokens, is kept under when no profile is
+// selected.
+const defaultProfileKey = "default"
 
 var once sync.Once
 var instance *defaultConfiguration
@@ -34,6 +43,15 @@ type Configuration interface {
 	GetLocalEGAInstanceURL() string
 	GetElixirAAIToken() string
 	GetChunkSize() int
+	GetReadAheadChunks() int
+	GetHTTPAttempts() int
+	GetTSDTokenJWKSURL() string
+	GetTSDTokenKey() string
+	GetTSDTokenAudience() string
+	GetIngestionPublicKey() string
+	GetKeysDirectory() string
+	GetResumeJournalDirectory() string
+	GetProfile() string
 }
 
 func (defaultConfiguration) ConcatenateURLPartsToString(array []string) string {
@@ -41,41 +59,42 @@ func (defaultConfiguration) ConcatenateURLPartsToString(array []string) string {
 	return str
 }
 
-// defaultConfiguration structure is a default implementation of the Configuration interface.
+// defaultConfiguration structure is a default implementation of the Configuration interface. Every setting is taken
+// from the command line flag, the selected profile, the environment variable or the configuration file, in this order.
 type defaultConfiguration struct {
+	file *configurationFile
 }
 
-func (defaultConfiguration) GetCentralEGAUsername() string {
-	centralEGAUsername := os.Getenv("CENTRAL_EGA_USERNAME")
+func (dc defaultConfiguration) GetCentralEGAUsername() string {
+	centralEGAUsername := dc.value("central_ega_username")
 	if centralEGAUsername == "" {
-		log.Fatal(aurora.Red("CENTRAL_EGA_USERNAME environment variable is not set"))
+		log.Fatal(aurora.Red(notSetMessage("central_ega_username")))
 	}
 	return centralEGAUsername
 }
 
-func (defaultConfiguration) GetCentralEGAPassword() string {
-	centralEGAPassword := os.Getenv("CENTRAL_EGA_PASSWORD")
+func (dc defaultConfiguration) GetCentralEGAPassword() string {
+	centralEGAPassword, err := dc.credential(CentralEGAPassword)
+	if err != nil {
+		log.Fatal(aurora.Red(err))
+	}
 	if centralEGAPassword == "" {
-		log.Fatal(aurora.Red("CENTRAL_EGA_PASSWORD environment variable is not set"))
+		log.Fatal(aurora.Red("CENTRAL_EGA_PASSWORD is not found, store it with \"credentials set central_ega_password\""))
 	}
 	return centralEGAPassword
 }
 
-func (defaultConfiguration) GetLocalEGAInstanceURL() string {
-	localEGAInstanceURL := os.Getenv("LOCAL_EGA_INSTANCE_URL")
-	if localEGAInstanceURL == "" {
-		localEGAInstanceURL = defaultInstanceURL
-	}
-	if strings.HasSuffix(localEGAInstanceURL, "/") {
-		return localEGAInstanceURL[:len(localEGAInstanceURL)-1]
-	}
-	return localEGAInstanceURL
+func (dc defaultConfiguration) GetLocalEGAInstanceURL() string {
+	return strings.TrimSuffix(dc.value("instance_url"), "/")
 }
 
-func (defaultConfiguration) GetElixirAAIToken() string {
-	elixirAAIToken := os.Getenv("ELIXIR_AAI_TOKEN")
+func (dc defaultConfiguration) GetElixirAAIToken() string {
+	elixirAAIToken, err := dc.credential(ElixirAAIToken)
+	if err != nil {
+		log.Fatal(aurora.Red(err))
+	}
 	if elixirAAIToken == "" {
-		log.Fatal(aurora.Red("ELIXIR_AAI_TOKEN environment variable is not set"))
+		log.Fatal(aurora.Red("ELIXIR_AAI_TOKEN is not found, store it with \"credentials set elixir_aai_token\""))
 	}
 	return elixirAAIToken
 }
@@ -87,49 +106,112 @@ func (dc defaultConfiguration) GetTSDURL() string {
 	)
 }
 
-func (defaultConfiguration) GetTSDbaseURL() string {
-	TSDbaseURL := os.Getenv("TSD_BASE_URL")
-	if TSDbaseURL == "" {
-		TSDbaseURL = defaultTSDfileAPIbaseURL
-	}
-	if strings.HasSuffix(TSDbaseURL, "/") {
-		return TSDbaseURL[:len(TSDbaseURL)-1]
-	}
-	return TSDbaseURL
+func (dc defaultConfiguration) GetTSDbaseURL() string {
+	return strings.TrimSuffix(dc.value("tsd_base_url"), "/")
 }
 
 func (defaultConfiguration) GetTSDAPIVersion() string {
 	return defaultTSDFileAPIVersion
 }
 
-func (defaultConfiguration) GetTSDProjectName() string {
-	tsdProject := os.Getenv("TSD_PROJ_NAME")
-	if tsdProject == "" {
-		tsdProject = defaultTSDProject
-	}
-	return tsdProject
+func (dc defaultConfiguration) GetTSDProjectName() string {
+	return dc.value("tsd_project")
 }
 
-func (defaultConfiguration) GetTSDservice() string {
-	return defaultTSDService
+func (dc defaultConfiguration) GetTSDservice() string {
+	return dc.value("tsd_service")
 }
 
-func (defaultConfiguration) GetChunkSize() int {
-	chunkSize := os.Getenv("LEGA_COMMANDER_CHUNK_SIZE")
-	if chunkSize == "" {
-		return defaultChunkSize
-	}
-	numericChunkSize, err := strconv.Atoi(chunkSize)
-	if err != nil {
+// GetChunkSize returns the size of the uploaded chunks in megabytes, the default one if the setting is not a positive
+// number.
+func (dc defaultConfiguration) GetChunkSize() int {
+	numericChunkSize, err := strconv.Atoi(dc.value("chunk_size"))
+	if err != nil || numericChunkSize < 1 {
 		return defaultChunkSize
 	}
 	return numericChunkSize
 }
 
+// GetReadAheadChunks returns how many chunks of an uploaded file are read and checksummed ahead of the one being sent.
+func (dc defaultConfiguration) GetReadAheadChunks() int {
+	numericReadAheadChunks, err := strconv.Atoi(dc.value("read_ahead_chunks"))
+	if err != nil || numericReadAheadChunks < 1 {
+		return defaultReadAheadChunks
+	}
+	return numericReadAheadChunks
+}
+
+// GetHTTPAttempts returns how many times a request failing with a network error or a temporary server error is made.
+func (dc defaultConfiguration) GetHTTPAttempts() int {
+	numericHTTPAttempts, err := strconv.Atoi(dc.value("http_attempts"))
+	if err != nil || numericHTTPAttempts < 1 {
+		return defaultHTTPAttempts
+	}
+	return numericHTTPAttempts
+}
+
+// GetTSDTokenJWKSURL returns the URL of the JSON Web Key Set to verify the signature of the TSD token with.
+func (dc defaultConfiguration) GetTSDTokenJWKSURL() string {
+	return dc.value("tsd_token_jwks_url")
+}
+
+// GetTSDTokenKey returns the path to the pinned PEM public key to verify the signature of the TSD token with. If neither
+// the key nor the JWKS URL is set, the signature of the token is not verified.
+func (dc defaultConfiguration) GetTSDTokenKey() string {
+	return dc.value("tsd_token_key")
+}
+
+// GetTSDTokenAudience returns the audience the TSD token has to be issued for, empty if it is not checked.
+func (dc defaultConfiguration) GetTSDTokenAudience() string {
+	return dc.value("tsd_token_audience")
+}
+
+// GetIngestionPublicKey returns the path or the URL of the public key files have to be encrypted for in order to be
+// ingested by the LocalEGA instance. Empty string means the recipient of the files is not checked.
+func (dc defaultConfiguration) GetIngestionPublicKey() string {
+	return dc.value("ingestion_pubkey")
+}
+
+// GetKeysDirectory returns the directory the Crypt4GH keys referenced by name are kept in.
+func (dc defaultConfiguration) GetKeysDirectory() string {
+	keysDirectory := dc.value("keys_dir")
+	if keysDirectory == "" {
+		log.Fatal(aurora.Red(notSetMessage("keys_dir")))
+	}
+	return keysDirectory
+}
+
+// GetResumeJournalDirectory returns the directory the progress of the uploads of the selected profile is recorded in.
+func (dc defaultConfiguration) GetResumeJournalDirectory() string {
+	journalDirectory := dc.value("resume_journal")
+	if journalDirectory == "" {
+		log.Fatal(aurora.Red(notSetMessage("resume_journal")))
+	}
+	return filepath.Join(journalDirectory, dc.profileKey())
+}
+
+// GetProfile returns the name of the selected profile of the configuration file, empty if none is selected.
+func (dc defaultConfiguration) GetProfile() string {
+	dc.file.mutex.Lock()
+	defer dc.file.mutex.Unlock()
+	if dc.file.profile != "" {
+		return dc.file.profile
+	}
+	return os.Getenv("LEGA_COMMANDER_PROFILE")
+}
+
+// profileKey returns the key the data of the user of the selected profile is kept under.
+func (dc defaultConfiguration) profileKey() string {
+	if profile := dc.GetProfile(); profile != "" {
+		return profile
+	}
+	return defaultProfileKey
+}
+
 // NewConfiguration constructs Configuration, accepting LocalEGA URL instance and possibly chunk size.
 func NewConfiguration() Configuration {
 	once.Do(func() {
-		instance = &defaultConfiguration{}
+		instance = &defaultConfiguration{file: &configurationFile{flags: map[string]string{}}}
 	})
 	return instance
 }
@@ -1,8 +1,18 @@
 package conf
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/elixir-oslo/lega-commander/auth"
 )
 
 func TestMain(m *testing.M) {
@@ -18,6 +28,7 @@ func setup() {
 	_ = os.Setenv("ELIXIR_AAI_TOKEN", "3")
 	_ = os.Setenv("TSD_PROJ_NAME", "5")
 	_ = os.Setenv("TSD_SERV", "6")
+	_ = os.Setenv("LEGA_COMMANDER_CONFIG", filepath.Join(os.TempDir(), "lega-commander-test-missing.yaml"))
 }
 
 func TestNewConfigurationSameInstance(t *testing.T) {
@@ -123,6 +134,73 @@ func TestNewConfigurationNonNumericChunkSize(t *testing.T) {
 		t.Error()
 	}
 }
+
+func TestNewConfigurationNonPositiveChunkSize(t *testing.T) {
+	for _, chunkSize := range []string{"0", "-5"} {
+		_ = os.Setenv("LEGA_COMMANDER_CHUNK_SIZE", chunkSize)
+		configuration := NewConfiguration()
+		if configuration.GetChunkSize() != defaultChunkSize {
+			t.Error(chunkSize)
+		}
+	}
+}
+func TestNewConfigurationDefaultReadAheadChunks(t *testing.T) {
+	configuration := NewConfiguration()
+	if configuration.GetReadAheadChunks() != defaultReadAheadChunks {
+		t.Error()
+	}
+}
+
+func TestNewConfigurationNonDefaultReadAheadChunks(t *testing.T) {
+	_ = os.Setenv("LEGA_COMMANDER_READ_AHEAD_CHUNKS", "4")
+	configuration := NewConfiguration()
+	if configuration.GetReadAheadChunks() != 4 {
+		t.Error()
+	}
+	_ = os.Setenv("LEGA_COMMANDER_READ_AHEAD_CHUNKS", "0")
+	if configuration.GetReadAheadChunks() != defaultReadAheadChunks {
+		t.Error()
+	}
+	_ = os.Unsetenv("LEGA_COMMANDER_READ_AHEAD_CHUNKS")
+}
+
+func TestNewConfigurationIngestionPublicKey(t *testing.T) {
+	configuration := NewConfiguration()
+	if configuration.GetIngestionPublicKey() != "" {
+		t.Error()
+	}
+	_ = os.Setenv("LEGA_COMMANDER_INGESTION_PUBKEY", "ega.pub")
+	if configuration.GetIngestionPublicKey() != "ega.pub" {
+		t.Error()
+	}
+	_ = os.Unsetenv("LEGA_COMMANDER_INGESTION_PUBKEY")
+}
+
+func TestNewConfigurationKeysDirectory(t *testing.T) {
+	configuration := NewConfiguration()
+	if !strings.HasSuffix(configuration.GetKeysDirectory(), filepath.Join("lega-commander", "keys")) {
+		t.Error(configuration.GetKeysDirectory())
+	}
+	_ = os.Setenv("LEGA_COMMANDER_KEYS_DIR", "/tmp/keys")
+	if configuration.GetKeysDirectory() != "/tmp/keys" {
+		t.Error()
+	}
+	_ = os.Unsetenv("LEGA_COMMANDER_KEYS_DIR")
+}
+
+func TestNewConfigurationResumeJournalDirectory(t *testing.T) {
+	configuration := newTestConfiguration(t, "profiles:\n  staging: {}\n")
+	_ = os.Setenv("LEGA_COMMANDER_RESUME_JOURNAL", "/tmp/journal")
+	defer os.Unsetenv("LEGA_COMMANDER_RESUME_JOURNAL")
+	if configuration.GetResumeJournalDirectory() != filepath.Join("/tmp/journal", "default") {
+		t.Error(configuration.GetResumeJournalDirectory())
+	}
+	configuration.setFlag("profile", "staging")
+	if configuration.GetResumeJournalDirectory() != filepath.Join("/tmp/journal", "staging") {
+		t.Error(configuration.GetResumeJournalDirectory())
+	}
+}
+
 func TestNewConfigurationGetTSDURL(t *testing.T) {
 	_ = os.Setenv("TSD_BASE_URL", "tsd_base/")
 
@@ -149,3 +227,328 @@ func teardown() {
 	_ = os.Unsetenv("ELIXIR_AAI_TOKEN")
 	_ = os.Unsetenv("LEGA_COMMANDER_CHUNK_SIZE")
 }
+
+func newTestConfiguration(t *testing.T, content string) defaultConfiguration {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if content != "" {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return defaultConfiguration{file: &configurationFile{path: path, flags: map[string]string{}}}
+}
+
+func TestConfigurationFileLayers(t *testing.T) {
+	_ = os.Unsetenv("LEGA_COMMANDER_CHUNK_SIZE")
+	_ = os.Unsetenv("LOCAL_EGA_INSTANCE_URL")
+	configuration := newTestConfiguration(t, "instance_url: https://file.example/\nchunk_size: 10\ntsd_service: files\n")
+	if configuration.GetLocalEGAInstanceURL() != "https://file.example" || configuration.GetChunkSize() != 10 ||
+		configuration.GetTSDservice() != "files" || configuration.GetReadAheadChunks() != defaultReadAheadChunks {
+		t.Error(configuration.GetLocalEGAInstanceURL(), configuration.GetChunkSize())
+	}
+	_ = os.Setenv("LEGA_COMMANDER_CHUNK_SIZE", "20")
+	defer os.Unsetenv("LEGA_COMMANDER_CHUNK_SIZE")
+	if configuration.GetChunkSize() != 20 {
+		t.Error()
+	}
+	configuration.setFlag("chunk_size", "30")
+	if configuration.GetChunkSize() != 30 {
+		t.Error()
+	}
+	settings, err := configuration.settings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, setting := range settings {
+		if setting.Name == "chunk_size" && setting.Source != SourceFlag ||
+			setting.Name == "instance_url" && setting.Source != SourceFile ||
+			setting.Name == "read_ahead_chunks" && setting.Source != SourceDefault {
+			t.Error(setting)
+		}
+	}
+}
+
+func TestConfigurationFileProfiles(t *testing.T) {
+	_ = os.Unsetenv("LOCAL_EGA_INSTANCE_URL")
+	_ = os.Setenv("TSD_PROJ_NAME", "env")
+	defer os.Setenv("TSD_PROJ_NAME", "5")
+	configuration := newTestConfiguration(t, `instance_url: https://ega.example
+tsd_project: file
+profiles:
+  staging:
+    instance_url: https://staging.ega.example
+    tsd_project: staging
+  local:
+    instance_url: http://localhost:8080
+`)
+	if configuration.GetProfile() != "" || configuration.GetLocalEGAInstanceURL() != "https://ega.example" ||
+		configuration.GetTSDProjectName() != "env" {
+		t.Error()
+	}
+	configuration.setFlag("profile", "staging")
+	if configuration.GetProfile() != "staging" || configuration.GetLocalEGAInstanceURL() != "https://staging.ega.example" ||
+		configuration.GetTSDProjectName() != "staging" {
+		t.Error()
+	}
+	configuration.setFlag("profile", "local")
+	if configuration.GetLocalEGAInstanceURL() != "http://localhost:8080" || configuration.GetTSDProjectName() != "env" {
+		t.Error()
+	}
+	configuration.setFlag("profile", "missing")
+	if _, err := configuration.settings(); err == nil || !strings.Contains(err.Error(), "profile missing is not defined") {
+		t.Error(err)
+	}
+	if err := configuration.set("tsd_project", "new"); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(configuration.file.path)
+	if err != nil || !strings.Contains(string(content), "    missing:\n        tsd_project: new\n") {
+		t.Error(string(content), err)
+	}
+	if configuration.GetTSDProjectName() != "new" {
+		t.Error()
+	}
+}
+
+func TestConfigurationFileSecrets(t *testing.T) {
+	_ = os.Unsetenv("ELIXIR_AAI_TOKEN")
+	defer os.Setenv("ELIXIR_AAI_TOKEN", "3")
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	_ = os.WriteFile(tokenFile, []byte("secret\n"), 0600)
+	configuration := newTestConfiguration(t, "elixir_aai_token_file: "+tokenFile+"\n")
+	if configuration.GetElixirAAIToken() != "secret" {
+		t.Error()
+	}
+}
+
+func TestCredentialStore(t *testing.T) {
+	_ = os.Unsetenv("CENTRAL_EGA_PASSWORD")
+	defer os.Setenv("CENTRAL_EGA_PASSWORD", "2")
+	_ = os.Setenv("LEGA_COMMANDER_STORE_PASSPHRASE", "passphrase")
+	defer os.Unsetenv("LEGA_COMMANDER_STORE_PASSPHRASE")
+	storePath := filepath.Join(t.TempDir(), "credentials")
+	configuration := newTestConfiguration(t, "credential_store: "+storePath+"\n")
+	store := configuration.credentialStore()
+	if err := store.SetCredential("unknown", "secret"); err == nil {
+		t.Error()
+	}
+	if err := store.SetCredential(CentralEGAPassword, "stored"); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(storePath)
+	if err != nil || strings.Contains(string(content), "stored") {
+		t.Error(string(content), err)
+	}
+	names, err := store.ListCredentials()
+	if err != nil || len(names) != 1 || names[0] != CentralEGAPassword {
+		t.Error(names, err)
+	}
+	if configuration.GetCentralEGAPassword() != "stored" {
+		t.Error()
+	}
+	wrongStore := CredentialStore{path: storePath, passphrase: []byte("wrong")}
+	if _, err = wrongStore.ListCredentials(); err == nil || !strings.Contains(err.Error(), "bad passphrase") {
+		t.Error(err)
+	}
+	if err = store.DeleteCredential(CentralEGAPassword); err != nil {
+		t.Fatal(err)
+	}
+	if names, err = store.ListCredentials(); err != nil || len(names) != 0 {
+		t.Error(names, err)
+	}
+}
+
+func TestCredentialHelper(t *testing.T) {
+	_ = os.Unsetenv("ELIXIR_AAI_TOKEN")
+	defer os.Setenv("ELIXIR_AAI_TOKEN", "3")
+	_ = os.Unsetenv("CENTRAL_EGA_PASSWORD")
+	defer os.Setenv("CENTRAL_EGA_PASSWORD", "2")
+	helper := filepath.Join(t.TempDir(), "helper.sh")
+	script := "#!/bin/sh\n[ \"$*\" = \"--vault test get elixir_aai_token\" ] && echo helper-token\n"
+	if err := os.WriteFile(helper, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	configuration := newTestConfiguration(t, "credential_helper: "+helper+" --vault test\n")
+	if configuration.GetElixirAAIToken() != "helper-token" {
+		t.Error()
+	}
+	if _, err := configuration.credential(CentralEGAPassword); err == nil ||
+		!strings.Contains(err.Error(), "credential helper") {
+		t.Error(err)
+	}
+}
+
+func TestCredentialsResolvedOnce(t *testing.T) {
+	_ = os.Unsetenv("ELIXIR_AAI_TOKEN")
+	defer os.Setenv("ELIXIR_AAI_TOKEN", "3")
+	_ = os.Unsetenv("CENTRAL_EGA_PASSWORD")
+	defer os.Setenv("CENTRAL_EGA_PASSWORD", "2")
+	directory := t.TempDir()
+	calls := filepath.Join(directory, "calls")
+	helper := filepath.Join(directory, "helper.sh")
+	script := "#!/bin/sh\necho call >> " + calls + "\n[ \"$*\" = \"get central_ega_password\" ] && echo helper-password\nexit 0\n"
+	if err := os.WriteFile(helper, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	var mutex sync.Mutex
+	prompts := 0
+	configuration := newTestConfiguration(t, "")
+	configuration.file.providers = []CredentialProvider{envCredentialProvider{}, execCredentialProvider{helper},
+		promptCredentialProvider{func(prompt string) (string, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			prompts++
+			return "prompted-token", nil
+		}}}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if configuration.GetCentralEGAPassword() != "helper-password" {
+				t.Error()
+			}
+			if configuration.GetElixirAAIToken() != "prompted-token" {
+				t.Error()
+			}
+		}()
+	}
+	wg.Wait()
+	content, err := os.ReadFile(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if helperCalls := strings.Count(string(content), "call"); helperCalls != 2 || prompts != 1 {
+		t.Error(helperCalls, prompts)
+	}
+}
+
+func TestLoginTokenRefresh(t *testing.T) {
+	_ = os.Unsetenv("ELIXIR_AAI_TOKEN")
+	defer os.Setenv("ELIXIR_AAI_TOKEN", "3")
+	var server *httptest.Server
+	refreshes := 0
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			_, _ = w.Write([]byte(`{"token_endpoint": "` + server.URL + `/token"}`))
+		case "/token":
+			if r.FormValue("grant_type") != "refresh_token" || r.FormValue("refresh_token") != "refresh" {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"error": "invalid_grant"}`))
+				return
+			}
+			refreshes++
+			_, _ = w.Write([]byte(`{"access_token": "fresh` + strconv.Itoa(refreshes) + `", "expires_in": 3600}`))
+		}
+	}))
+	defer server.Close()
+	t.Setenv("LEGA_COMMANDER_STORE_PASSPHRASE", "passphrase")
+	cachePath := filepath.Join(t.TempDir(), "tokens.json")
+	storePath := filepath.Join(t.TempDir(), "credentials")
+	configuration := newTestConfiguration(t, "oidc_issuer: "+server.URL+"\noidc_client_id: client\ntoken_cache: "+
+		cachePath+"\ncredential_store: "+storePath+"\nprofiles:\n  staging:\n    tsd_project: p11\n")
+	cache := configuration.tokenCache()
+	if err := cache.Store(defaultProfileKey, auth.Token{AccessToken: "cached", Expiry: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if configuration.GetElixirAAIToken() != "cached" {
+		t.Error()
+	}
+	configuration.setFlag("profile", "staging")
+	expired := auth.Token{AccessToken: "expired", RefreshToken: "refresh", Expiry: time.Now().Add(-time.Minute)}
+	if err := cache.Store("staging", expired); err != nil {
+		t.Fatal(err)
+	}
+	if configuration.GetElixirAAIToken() != "fresh1" {
+		t.Error()
+	}
+	token, err := cache.Load("staging")
+	if err != nil || token.AccessToken != "fresh1" || token.RefreshToken != "" {
+		t.Error("refresh token is left in the plaintext cache:", token, err)
+	}
+	content, err := os.ReadFile(cachePath)
+	if err != nil || strings.Contains(string(content), `"refresh"`) {
+		t.Error(string(content), err)
+	}
+	if stored, err := configuration.credentialStore().secret(refreshTokenName("staging")); stored != "refresh" || err != nil {
+		t.Error("refresh token is not in the credential store:", stored, err)
+	}
+	if refreshed, err := configuration.refreshElixirAAIToken(context.Background(), "fresh1"); !refreshed || err != nil {
+		t.Error(refreshed, err)
+	}
+	if configuration.GetElixirAAIToken() != "fresh2" || refreshes != 2 {
+		t.Error()
+	}
+	_ = os.Setenv("ELIXIR_AAI_TOKEN", "env")
+	if refreshed, err := configuration.refreshElixirAAIToken(context.Background(), "env"); refreshed || err != nil {
+		t.Error(refreshed, err)
+	}
+	_ = os.Unsetenv("ELIXIR_AAI_TOKEN")
+	expired.RefreshToken = "revoked"
+	if err = cache.Store("staging", expired); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = configuration.credential(ElixirAAIToken); err == nil || !strings.Contains(err.Error(), "login") {
+		t.Error(err)
+	}
+}
+
+func TestSetSetting(t *testing.T) {
+	configuration := newTestConfiguration(t, "")
+	if err := configuration.set("chunk_size", "25"); err != nil {
+		t.Fatal(err)
+	}
+	if err := configuration.set("tsd_project", "p11"); err != nil {
+		t.Fatal(err)
+	}
+	if err := configuration.set("tsd_project", ""); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(configuration.file.path)
+	if err != nil || string(content) != "chunk_size: \"25\"\n" {
+		t.Error(string(content), err)
+	}
+	if err = configuration.set("chunk_size", "large"); err == nil {
+		t.Error()
+	}
+	if err = configuration.set("unknown", "value"); err == nil || !strings.Contains(err.Error(), "instance_url") {
+		t.Error(err)
+	}
+}
+
+func TestValidateSettings(t *testing.T) {
+	_ = os.Unsetenv("LOCAL_EGA_INSTANCE_URL")
+	_ = os.Unsetenv("TSD_BASE_URL")
+	configuration := newTestConfiguration(t, "instance_url: ega.example\nunknown: value\nprofiles:\n  test:\n    other: value\n")
+	err := configuration.validate()
+	if err == nil || !strings.Contains(err.Error(), "unknown: setting is not known") ||
+		!strings.Contains(err.Error(), "profiles.test.other: setting is not known") ||
+		!strings.Contains(err.Error(), "instance_url (file): ega.example is not an http(s) URL") {
+		t.Error(err)
+	}
+	configuration = newTestConfiguration(t, "instance_url: https://ega.example\n")
+	if err = configuration.validate(); err != nil {
+		t.Error(err)
+	}
+	configuration = newTestConfiguration(t, "instance_url: https://ega.example\nchunk_size: 0\n")
+	if err = configuration.validate(); err == nil || !strings.Contains(err.Error(), "chunk_size (file): 0 is not a positive number") {
+		t.Error(err)
+	}
+	configuration = newTestConfiguration(t, "instance_url: [\n")
+	if err = configuration.validate(); err == nil {
+		t.Error()
+	}
+}
+
+func TestNotSetMessage(t *testing.T) {
+	message := notSetMessage("central_ega_username")
+	if message != "central_ega_username is not set, give it in the selected profile, with CENTRAL_EGA_USERNAME "+
+		"environment variable or in the configuration file, e.g. with config set central_ega_username VALUE" {
+		t.Error(message)
+	}
+	message = notSetMessage("instance_url")
+	if !strings.HasPrefix(message, "instance_url is not set, give it with --instance-url flag, in the selected profile, ") {
+		t.Error(message)
+	}
+}
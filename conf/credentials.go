@@ -0,0 +1,400 @@
+package conf
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+// Names of the credentials the application needs.
+const (
+	CentralEGAPassword = "central_ega_password"
+	ElixirAAIToken     = "elixir_aai_token"
+)
+
+var credentialNames = []string{CentralEGAPassword, ElixirAAIToken}
+
+// CredentialProvider interface provides secrets by their names. An empty secret with no error means the provider
+// does not know the secret, and the next provider is asked.
+type CredentialProvider interface {
+	GetCredential(name string) (string, error)
+}
+
+// envCredentialProvider takes the secrets from the environment variables, kept for backward compatibility.
+type envCredentialProvider struct{}
+
+func (envCredentialProvider) GetCredential(name string) (string, error) {
+	return os.Getenv(strings.ToUpper(name)), nil
+}
+
+// fileCredentialProvider reads the secrets from the plain files the <name>_file settings point to.
+type fileCredentialProvider struct {
+	configuration defaultConfiguration
+}
+
+func (p fileCredentialProvider) GetCredential(name string) (string, error) {
+	s, ok := findSetting(name + "_file")
+	if !ok {
+		return "", nil
+	}
+	path, _, err := p.configuration.lookup(s)
+	if err != nil || path == "" {
+		return "", err
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// execCredentialProvider runs the credential helper command as "<command> get <name>", taking the first line of its
+// output as the secret, like git credential helpers do.
+type execCredentialProvider struct {
+	command string
+}
+
+func (p execCredentialProvider) GetCredential(name string) (string, error) {
+	fields := strings.Fields(p.command)
+	if len(fields) == 0 {
+		return "", nil
+	}
+	command := exec.Command(fields[0], append(fields[1:], "get", name)...)
+	command.Stderr = os.Stderr
+	output, err := command.Output()
+	if err != nil {
+		return "", fmt.Errorf("credential helper %v failed: %v", fields[0], err)
+	}
+	secret, _, _ := strings.Cut(string(output), "\n")
+	return strings.TrimSpace(secret), nil
+}
+
+// storeCredentialProvider takes the secrets from the encrypted credential store, if there is one.
+type storeCredentialProvider struct {
+	store *CredentialStore
+}
+
+func (p storeCredentialProvider) GetCredential(name string) (string, error) {
+	return p.store.secret(name)
+}
+
+// promptCredentialProvider asks for the secrets interactively.
+type promptCredentialProvider struct {
+	prompt func(prompt string) (string, error)
+}
+
+func (p promptCredentialProvider) GetCredential(name string) (string, error) {
+	return p.prompt("Enter " + strings.ReplaceAll(name, "_", " ") + ": ")
+}
+
+// promptOnTerminal prompts for the secret if the standard input is a terminal, returning empty secret otherwise.
+func promptOnTerminal(prompt string) (string, error) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return "", nil
+	}
+	return readSecret(prompt)
+}
+
+// keepsCredentials tells whether the secrets of the provider are kept once resolved, because asking the provider is
+// slow or interactive: the credential helper is run, the store is decrypted or the user is prompted.
+func keepsCredentials(provider CredentialProvider) bool {
+	switch provider.(type) {
+	case execCredentialProvider, storeCredentialProvider, promptCredentialProvider:
+		return true
+	}
+	return false
+}
+
+// CredentialStore structure represents the file keeping the secrets encrypted with a key derived from the passphrase.
+type CredentialStore struct {
+	path       string
+	mutex      sync.Mutex
+	passphrase []byte
+}
+
+// encryptedCredentials structure is the content of the credential store file.
+type encryptedCredentials struct {
+	Salt  []byte `json:"salt"`
+	Nonce []byte `json:"nonce"`
+	Data  []byte `json:"data"`
+}
+
+// NewCredentialStore constructs CredentialStore of the configured path. The passphrase is taken from
+// LEGA_COMMANDER_STORE_PASSPHRASE environment variable or prompted for once it is needed.
+func NewCredentialStore() *CredentialStore {
+	return NewConfiguration().(*defaultConfiguration).credentialStore()
+}
+
+// SetCredential stores the secret under the name, creating the store if needed. Empty secret removes it.
+func (cs *CredentialStore) SetCredential(name, secret string) error {
+	if !isCredentialName(name) {
+		return fmt.Errorf("credential %v is not known, use one of: %v", name, strings.Join(credentialNames, ", "))
+	}
+	return cs.setSecret(name, secret)
+}
+
+// setSecret stores the secret under any name, creating the store if needed. Empty secret removes it.
+func (cs *CredentialStore) setSecret(name, secret string) error {
+	if cs.path == "" {
+		return errors.New("credential store can not be located, set LEGA_COMMANDER_CREDENTIAL_STORE")
+	}
+	secrets := map[string]string{}
+	if _, err := os.Stat(cs.path); err == nil {
+		if secrets, err = cs.read(); err != nil {
+			return err
+		}
+	} else if err = cs.newPassphrase(); err != nil {
+		return err
+	}
+	if secret == "" {
+		delete(secrets, name)
+	} else {
+		secrets[name] = secret
+	}
+	return cs.write(secrets)
+}
+
+// DeleteCredential removes the secret from the store.
+func (cs *CredentialStore) DeleteCredential(name string) error {
+	return cs.SetCredential(name, "")
+}
+
+// ListCredentials lists the names of the stored secrets.
+func (cs *CredentialStore) ListCredentials() ([]string, error) {
+	if _, err := os.Stat(cs.path); os.IsNotExist(err) {
+		return nil, nil
+	}
+	secrets, err := cs.read()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(secrets))
+	for name := range secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// secret returns the secret stored under the name, empty if there is none or if there is no store.
+func (cs *CredentialStore) secret(name string) (string, error) {
+	if _, err := os.Stat(cs.path); os.IsNotExist(err) {
+		return "", nil
+	}
+	secrets, err := cs.read()
+	if err != nil {
+		return "", err
+	}
+	return secrets[name], nil
+}
+
+func (cs *CredentialStore) read() (map[string]string, error) {
+	content, err := os.ReadFile(cs.path)
+	if err != nil {
+		return nil, err
+	}
+	var encrypted encryptedCredentials
+	if err = json.Unmarshal(content, &encrypted); err != nil {
+		return nil, fmt.Errorf("%v: %v", cs.path, err)
+	}
+	passphrase, err := cs.unlockingPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	key, err := scrypt.Key(passphrase, encrypted.Salt, 1<<15, 8, 1, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(encrypted.Nonce) != aead.NonceSize() {
+		return nil, errors.New(cs.path + ": credential store is damaged")
+	}
+	data, err := aead.Open(nil, encrypted.Nonce, encrypted.Data, nil)
+	if err != nil {
+		return nil, errors.New(cs.path + ": bad passphrase or damaged credential store")
+	}
+	secrets := map[string]string{}
+	if err = json.Unmarshal(data, &secrets); err != nil {
+		return nil, fmt.Errorf("%v: %v", cs.path, err)
+	}
+	return secrets, nil
+}
+
+func (cs *CredentialStore) write(secrets map[string]string) error {
+	data, err := json.Marshal(secrets)
+	if err != nil {
+		return err
+	}
+	encrypted := encryptedCredentials{Salt: make([]byte, 16), Nonce: make([]byte, chacha20poly1305.NonceSizeX)}
+	if _, err = rand.Read(encrypted.Salt); err != nil {
+		return err
+	}
+	if _, err = rand.Read(encrypted.Nonce); err != nil {
+		return err
+	}
+	cs.mutex.Lock()
+	passphrase := cs.passphrase
+	cs.mutex.Unlock()
+	key, err := scrypt.Key(passphrase, encrypted.Salt, 1<<15, 8, 1, chacha20poly1305.KeySize)
+	if err != nil {
+		return err
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return err
+	}
+	encrypted.Data = aead.Seal(nil, encrypted.Nonce, data, nil)
+	content, err := json.Marshal(encrypted)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(cs.path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(cs.path, content, 0600)
+}
+
+// unlockingPassphrase returns the passphrase to unlock the store with, prompting for it the first time it is needed.
+func (cs *CredentialStore) unlockingPassphrase() ([]byte, error) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	if cs.passphrase == nil {
+		passphrase, err := readSecret("Enter the passphrase to unlock " + cs.path + ": ")
+		if err != nil {
+			return nil, err
+		}
+		cs.passphrase = []byte(passphrase)
+	}
+	return cs.passphrase, nil
+}
+
+// newPassphrase prompts twice for the passphrase to lock the new store with, unless it is already known.
+func (cs *CredentialStore) newPassphrase() error {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	if cs.passphrase != nil {
+		return nil
+	}
+	passphrase, err := readSecret("Enter the passphrase to lock " + cs.path + ": ")
+	if err != nil {
+		return err
+	}
+	confirmation, err := readSecret("Enter the same passphrase again: ")
+	if err != nil {
+		return err
+	}
+	if passphrase != confirmation {
+		return errors.New("passphrases do not match")
+	}
+	if passphrase == "" {
+		return errors.New("credential store has to be protected with a passphrase")
+	}
+	cs.passphrase = []byte(passphrase)
+	return nil
+}
+
+// credential asks the providers in turn for the secret: the environment variable, the file, the tokens cached by the
+// login command, the credential helper, the encrypted store and finally the user. The secrets the credential helper,
+// the store or the user give are kept for the lifetime of the configuration, as they are needed for every request;
+// the secrets are resolved one at a time, so that concurrent uploads never prompt the user at once.
+func (dc defaultConfiguration) credential(name string) (string, error) {
+	dc.file.credentialsMutex.Lock()
+	defer dc.file.credentialsMutex.Unlock()
+	if secret, ok := dc.file.credentials[name]; ok {
+		return secret, nil
+	}
+	for _, provider := range dc.credentialProviders() {
+		secret, err := provider.GetCredential(name)
+		if err != nil || secret != "" {
+			if err == nil && keepsCredentials(provider) {
+				if dc.file.credentials == nil {
+					dc.file.credentials = map[string]string{}
+				}
+				dc.file.credentials[name] = secret
+			}
+			return secret, err
+		}
+	}
+	return "", nil
+}
+
+func (dc defaultConfiguration) credentialProviders() []CredentialProvider {
+	dc.file.mutex.Lock()
+	providers := dc.file.providers
+	dc.file.mutex.Unlock()
+	if providers != nil {
+		return providers
+	}
+	providers = []CredentialProvider{envCredentialProvider{}, fileCredentialProvider{dc},
+		tokenCredentialProvider{dc, &sync.Mutex{}}}
+	if helper := dc.value("credential_helper"); helper != "" {
+		providers = append(providers, execCredentialProvider{helper})
+	}
+	providers = append(providers, storeCredentialProvider{dc.credentialStore()}, promptCredentialProvider{promptOnTerminal})
+	dc.file.mutex.Lock()
+	dc.file.providers = providers
+	dc.file.mutex.Unlock()
+	return providers
+}
+
+// credentialStore returns the credential store of the configured path, the same one as long as the path is the same.
+func (dc defaultConfiguration) credentialStore() *CredentialStore {
+	path := dc.value("credential_store")
+	dc.file.mutex.Lock()
+	defer dc.file.mutex.Unlock()
+	if dc.file.store == nil || dc.file.store.path != path {
+		dc.file.store = &CredentialStore{path: path}
+		if passphrase, ok := os.LookupEnv("LEGA_COMMANDER_STORE_PASSPHRASE"); ok {
+			dc.file.store.passphrase = []byte(passphrase)
+		}
+	}
+	return dc.file.store
+}
+
+// ReadCredential reads the secret to store: it is prompted for if the standard input is a terminal, or read as the
+// first line of the standard input otherwise, so that it never has to be given on the command line.
+func ReadCredential(name string) (string, error) {
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		return readSecret("Enter " + strings.ReplaceAll(name, "_", " ") + ": ")
+	}
+	secret, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimSpace(secret), nil
+}
+
+// isCredentialName tells whether the name is one of the credentials the application needs.
+func isCredentialName(name string) bool {
+	for _, credentialName := range credentialNames {
+		if name == credentialName {
+			return true
+		}
+	}
+	return false
+}
+
+// readSecret prompts for the secret without echoing it.
+func readSecret(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	secret, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	return string(bytes.TrimSpace(secret)), err
+}
@@ -0,0 +1,426 @@
+package conf
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	aurora "github.com/logrusorgru/aurora/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// Sources of the setting values, from the most to the least preferred one.
+const (
+	SourceFlag    = "flag"
+	SourceProfile = "profile"
+	SourceEnv     = "env"
+	SourceFile    = "file"
+	SourceDefault = "default"
+)
+
+// setting structure describes a single setting: its name in the configuration file, the command line flag and the
+// environment variable overriding it, and the way to get its default value and to check a value.
+type setting struct {
+	name         string
+	flag         string
+	env          string
+	defaultValue func() string
+	check        func(value string) error
+}
+
+var settings = []setting{
+	{name: "instance_url", flag: "--instance-url", env: "LOCAL_EGA_INSTANCE_URL", defaultValue: constant(defaultInstanceURL), check: checkURL},
+	{name: "tsd_base_url", flag: "--tsd-url", env: "TSD_BASE_URL", defaultValue: constant(defaultTSDfileAPIbaseURL), check: checkURL},
+	{name: "tsd_project", flag: "--tsd-project", env: "TSD_PROJ_NAME", defaultValue: constant(defaultTSDProject)},
+	{name: "tsd_service", defaultValue: constant(defaultTSDService)},
+	{name: "chunk_size", flag: "--chunk-size", env: "LEGA_COMMANDER_CHUNK_SIZE", defaultValue: constant(strconv.Itoa(defaultChunkSize)), check: checkPositive},
+	{name: "read_ahead_chunks", env: "LEGA_COMMANDER_READ_AHEAD_CHUNKS", defaultValue: constant(strconv.Itoa(defaultReadAheadChunks)), check: checkPositive},
+	{name: "http_attempts", env: "LEGA_COMMANDER_HTTP_ATTEMPTS", defaultValue: constant(strconv.Itoa(defaultHTTPAttempts)), check: checkPositive},
+	{name: "ingestion_pubkey", env: "LEGA_COMMANDER_INGESTION_PUBKEY", check: checkPathOrURL},
+	{name: "keys_dir", env: "LEGA_COMMANDER_KEYS_DIR", defaultValue: inConfigDirectory("keys")},
+	{name: "tsd_token_jwks_url", env: "LEGA_COMMANDER_TSD_TOKEN_JWKS_URL", check: checkURL},
+	{name: "tsd_token_key", env: "LEGA_COMMANDER_TSD_TOKEN_KEY", check: checkFile},
+	{name: "tsd_token_audience", env: "LEGA_COMMANDER_TSD_TOKEN_AUDIENCE"},
+	{name: "central_ega_username", env: "CENTRAL_EGA_USERNAME"},
+	{name: "central_ega_password_file", check: checkFile},
+	{name: "elixir_aai_token_file", check: checkFile},
+	{name: "credential_helper", env: "LEGA_COMMANDER_CREDENTIAL_HELPER"},
+	{name: "credential_store", env: "LEGA_COMMANDER_CREDENTIAL_STORE", defaultValue: inConfigDirectory("credentials")},
+	{name: "oidc_issuer", env: "LEGA_COMMANDER_OIDC_ISSUER", defaultValue: constant(defaultOIDCIssuer), check: checkURL},
+	{name: "oidc_client_id", env: "LEGA_COMMANDER_OIDC_CLIENT_ID"},
+	{name: "oidc_scope", defaultValue: constant(defaultOIDCScope)},
+	{name: "token_cache", env: "LEGA_COMMANDER_TOKEN_CACHE", defaultValue: inConfigDirectory("tokens.json")},
+	{name: "resume_journal", env: "LEGA_COMMANDER_RESUME_JOURNAL", defaultValue: inConfigDirectory("journal")},
+}
+
+// Setting structure represents the effective value of a setting along with where it comes from.
+type Setting struct {
+	Name   string
+	Value  string
+	Source string
+}
+
+// fileContent structure represents the configuration file: the settings at the top level, and the named profiles
+// whose settings override them once the profile is selected.
+type fileContent struct {
+	Settings map[string]string            `yaml:",inline"`
+	Profiles map[string]map[string]string `yaml:"profiles,omitempty"`
+}
+
+// configurationFile structure holds the content loaded from the configuration file and the values given as flags.
+type configurationFile struct {
+	once    sync.Once
+	path    string
+	content fileContent
+	err     error
+	mutex   sync.Mutex
+	profile string
+	flags   map[string]string
+	// providers are the credential providers, built once the first secret is needed.
+	providers []CredentialProvider
+	// credentials are the secrets kept once resolved, by their names.
+	credentials      map[string]string
+	credentialsMutex sync.Mutex
+	// store is the credential store, kept so that its passphrase is asked for once.
+	store *CredentialStore
+}
+
+// GetConfigurationFilePath returns the path of the YAML configuration file: the one given as the flag, or
+// LEGA_COMMANDER_CONFIG if set, or lega-commander/config.yaml under the user config directory.
+func GetConfigurationFilePath() string {
+	file := NewConfiguration().(*defaultConfiguration).file
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+	if file.path != "" {
+		return file.path
+	}
+	return defaultConfigurationFilePath()
+}
+
+// defaultConfigurationFilePath returns the path of the configuration file when it is not given as the flag.
+func defaultConfigurationFilePath() string {
+	if path := os.Getenv("LEGA_COMMANDER_CONFIG"); path != "" {
+		return path
+	}
+	configDirectory, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(configDirectory, "lega-commander", "config.yaml")
+}
+
+// SetFlag overrides the setting with the value given on the command line. The configuration file is set with the
+// "config" name, before any setting is read, and the profile with the "profile" name.
+func SetFlag(name, value string) {
+	NewConfiguration().(*defaultConfiguration).setFlag(name, value)
+}
+
+// Profiles lists the names of the profiles defined in the configuration file.
+func Profiles() ([]string, error) {
+	content, err := NewConfiguration().(*defaultConfiguration).file.load()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(content.Profiles))
+	for name := range content.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Settings returns the effective values of all the settings.
+func Settings() ([]Setting, error) {
+	return NewConfiguration().(*defaultConfiguration).settings()
+}
+
+// SetSetting checks the value and stores it in the configuration file, creating the file if needed. The value goes to
+// the selected profile, if any, or to the top level otherwise. Empty value removes the setting from the file.
+func SetSetting(name, value string) error {
+	return NewConfiguration().(*defaultConfiguration).set(name, value)
+}
+
+// ValidateSettings checks the configuration file and the effective values of all the settings, returning all the
+// problems found as a single error.
+func ValidateSettings() error {
+	return NewConfiguration().(*defaultConfiguration).validate()
+}
+
+func (dc defaultConfiguration) setFlag(name, value string) {
+	dc.file.mutex.Lock()
+	defer dc.file.mutex.Unlock()
+	switch name {
+	case "config":
+		dc.file.path = value
+		return
+	case "profile":
+		dc.file.profile = value
+		return
+	}
+	dc.file.flags[name] = value
+}
+
+func (dc defaultConfiguration) settings() ([]Setting, error) {
+	result := make([]Setting, 0, len(settings))
+	for _, s := range settings {
+		value, source, err := dc.lookup(s)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, Setting{Name: s.name, Value: value, Source: source})
+	}
+	return result, nil
+}
+
+func (dc defaultConfiguration) set(name, value string) error {
+	s, ok := findSetting(name)
+	if !ok {
+		return fmt.Errorf("setting %v is not known, use one of: %v", name, strings.Join(settingNames(), ", "))
+	}
+	if s.check != nil && value != "" {
+		if err := s.check(value); err != nil {
+			return fmt.Errorf("%v: %v", name, err)
+		}
+	}
+	content, err := dc.file.load()
+	if err != nil {
+		return err
+	}
+	if dc.file.path == "" {
+		return errors.New("configuration file can not be located, set LEGA_COMMANDER_CONFIG")
+	}
+	values := content.Settings
+	if profile := dc.GetProfile(); profile != "" {
+		if content.Profiles[profile] == nil {
+			if content.Profiles == nil {
+				content.Profiles = map[string]map[string]string{}
+			}
+			content.Profiles[profile] = map[string]string{}
+		}
+		values = content.Profiles[profile]
+	}
+	if value == "" {
+		delete(values, name)
+	} else {
+		values[name] = value
+	}
+	if err = os.MkdirAll(filepath.Dir(dc.file.path), 0700); err != nil {
+		return err
+	}
+	marshalled, err := yaml.Marshal(content)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dc.file.path, marshalled, 0600)
+}
+
+func (dc defaultConfiguration) validate() error {
+	content, err := dc.file.load()
+	if err != nil {
+		return err
+	}
+	var problems []string
+	for name := range content.Settings {
+		if _, ok := findSetting(name); !ok {
+			problems = append(problems, fmt.Sprintf("%v: setting is not known", name))
+		}
+	}
+	for profile, values := range content.Profiles {
+		for name := range values {
+			if _, ok := findSetting(name); !ok {
+				problems = append(problems, fmt.Sprintf("profiles.%v.%v: setting is not known", profile, name))
+			}
+		}
+	}
+	sort.Strings(problems)
+	for _, s := range settings {
+		value, source, err := dc.lookup(s)
+		if err != nil {
+			return err
+		}
+		if s.check == nil || value == "" {
+			continue
+		}
+		if err := s.check(value); err != nil {
+			problems = append(problems, fmt.Sprintf("%v (%v): %v", s.name, source, err))
+		}
+	}
+	if len(problems) != 0 {
+		return errors.New("configuration is not valid:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// value returns the effective value of the named setting, exiting if the configuration file can not be read.
+func (dc defaultConfiguration) value(name string) string {
+	s, _ := findSetting(name)
+	value, _, err := dc.lookup(s)
+	if err != nil {
+		log.Fatal(aurora.Red(err))
+	}
+	return value
+}
+
+// notSetMessage tells where the named setting, found nowhere, can be given: the flag, the selected profile, the
+// environment variable or the configuration file, whichever the setting supports.
+func notSetMessage(name string) string {
+	s, _ := findSetting(name)
+	var sources []string
+	if s.flag != "" {
+		sources = append(sources, "with "+s.flag+" flag")
+	}
+	sources = append(sources, "in the selected profile")
+	if s.env != "" {
+		sources = append(sources, "with "+s.env+" environment variable")
+	}
+	sources = append(sources, "in the configuration file")
+	return fmt.Sprintf("%v is not set, give it %v or %v, e.g. with config set %v VALUE", name,
+		strings.Join(sources[:len(sources)-1], ", "), sources[len(sources)-1], name)
+}
+
+// lookup returns the value of the setting and its source: the flag, the selected profile, the environment variable,
+// the top level of the configuration file or the default value, whichever is found first.
+func (dc defaultConfiguration) lookup(s setting) (string, string, error) {
+	dc.file.mutex.Lock()
+	value, ok := dc.file.flags[s.name]
+	dc.file.mutex.Unlock()
+	if ok && value != "" {
+		return value, SourceFlag, nil
+	}
+	content, err := dc.file.load()
+	if err != nil {
+		return "", "", err
+	}
+	if profile := dc.GetProfile(); profile != "" {
+		values, ok := content.Profiles[profile]
+		if !ok {
+			return "", "", fmt.Errorf("profile %v is not defined in %v", profile, dc.file.path)
+		}
+		if value = values[s.name]; value != "" {
+			return value, SourceProfile, nil
+		}
+	}
+	if s.env != "" {
+		if value = os.Getenv(s.env); value != "" {
+			return value, SourceEnv, nil
+		}
+	}
+	if value = content.Settings[s.name]; value != "" {
+		return value, SourceFile, nil
+	}
+	if s.defaultValue != nil {
+		return s.defaultValue(), SourceDefault, nil
+	}
+	return "", SourceDefault, nil
+}
+
+// load reads the configuration file once; a missing file is the same as an empty one.
+func (cf *configurationFile) load() (*fileContent, error) {
+	cf.once.Do(func() {
+		cf.mutex.Lock()
+		if cf.path == "" {
+			cf.path = defaultConfigurationFilePath()
+		}
+		cf.mutex.Unlock()
+		cf.content.Settings = map[string]string{}
+		if cf.path == "" {
+			return
+		}
+		content, err := os.ReadFile(cf.path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				cf.err = err
+			}
+			return
+		}
+		if err = yaml.Unmarshal(content, &cf.content); err != nil {
+			cf.err = fmt.Errorf("%v: %v", cf.path, err)
+		}
+		if cf.content.Settings == nil {
+			cf.content.Settings = map[string]string{}
+		}
+	})
+	return &cf.content, cf.err
+}
+
+// findSetting looks the setting up by its name.
+func findSetting(name string) (setting, bool) {
+	for _, s := range settings {
+		if s.name == name {
+			return s, true
+		}
+	}
+	return setting{}, false
+}
+
+// settingNames lists the names of all the settings.
+func settingNames() []string {
+	names := make([]string, len(settings))
+	for i, s := range settings {
+		names[i] = s.name
+	}
+	return names
+}
+
+// constant returns the default value function always returning the value.
+func constant(value string) func() string {
+	return func() string {
+		return value
+	}
+}
+
+// inConfigDirectory returns the default value function returning the path of the file or the directory under
+// lega-commander directory of the user config directory.
+func inConfigDirectory(name string) func() string {
+	return func() string {
+		configDirectory, err := os.UserConfigDir()
+		if err != nil {
+			return ""
+		}
+		return filepath.Join(configDirectory, "lega-commander", name)
+	}
+}
+
+func checkURL(value string) error {
+	parsedURL, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+	if parsedURL.Scheme != "http" && parsedURL.Scheme != "https" || parsedURL.Host == "" {
+		return errors.New(value + " is not an http(s) URL")
+	}
+	return nil
+}
+
+func checkPositive(value string) error {
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 1 {
+		return errors.New(value + " is not a positive number")
+	}
+	return nil
+}
+
+func checkFile(value string) error {
+	stat, err := os.Stat(value)
+	if err != nil {
+		return err
+	}
+	if stat.IsDir() {
+		return errors.New(value + " is a directory")
+	}
+	return nil
+}
+
+func checkPathOrURL(value string) error {
+	if strings.HasPrefix(value, "http://") || strings.HasPrefix(value, "https://") {
+		return checkURL(value)
+	}
+	return checkFile(value)
+}
@@ -0,0 +1,174 @@
+package conf
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/elixir-oslo/lega-commander/auth"
+	"github.com/elixir-oslo/lega-commander/requests"
+)
+
+// tokenRefreshMargin is how long before its expiry the cached access token is refreshed.
+const tokenRefreshMargin = time.Minute
+
+// Login performs the device authorization flow against the configured OIDC issuer, passing the user code to notify,
+// and caches the issued tokens for the selected profile.
+func Login(ctx context.Context, notify func(authorization auth.DeviceAuthorization)) (*auth.Token, error) {
+	dc := NewConfiguration().(*defaultConfiguration)
+	provider, err := dc.authProvider()
+	if err != nil {
+		return nil, err
+	}
+	token, err := provider.Login(ctx, notify)
+	if err != nil {
+		return nil, err
+	}
+	if err = dc.storeToken(*token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// Logout removes the cached tokens of the selected profile, along with the refresh token in the credential store.
+func Logout() error {
+	dc := NewConfiguration().(*defaultConfiguration)
+	store := dc.credentialStore()
+	name := refreshTokenName(dc.profileKey())
+	refreshToken, err := store.secret(name)
+	if err != nil {
+		return err
+	}
+	if refreshToken != "" {
+		if err = store.setSecret(name, ""); err != nil {
+			return err
+		}
+	}
+	return dc.tokenCache().Delete(dc.profileKey())
+}
+
+// CachedToken returns the cached tokens of the selected profile, with the refresh token taken from the credential
+// store, nil if the user has not logged in.
+func CachedToken() (*auth.Token, error) {
+	dc := NewConfiguration().(*defaultConfiguration)
+	token, err := dc.tokenCache().Load(dc.profileKey())
+	if err != nil || token == nil {
+		return token, err
+	}
+	if token.RefreshToken == "" {
+		if token.RefreshToken, err = dc.credentialStore().secret(refreshTokenName(dc.profileKey())); err != nil {
+			return nil, err
+		}
+	}
+	return token, nil
+}
+
+// refreshTokenName returns the name the refresh token of the profile key is kept under in the credential store.
+func refreshTokenName(key string) string {
+	return "refresh_token." + key
+}
+
+// storeToken caches the access token of the selected profile. Its refresh token, which is long-lived, is kept in the
+// encrypted credential store rather than in the plaintext cache.
+func (dc defaultConfiguration) storeToken(token auth.Token) error {
+	key := dc.profileKey()
+	if token.RefreshToken != "" {
+		store := dc.credentialStore()
+		stored, err := store.secret(refreshTokenName(key))
+		if err != nil {
+			return err
+		}
+		if stored != token.RefreshToken {
+			if err = store.setSecret(refreshTokenName(key), token.RefreshToken); err != nil {
+				return err
+			}
+		}
+		token.RefreshToken = ""
+	}
+	return dc.tokenCache().Store(key, token)
+}
+
+// tokenCredentialProvider provides ELIXIR AAI token obtained with the login command, refreshing it once it is about
+// to expire.
+type tokenCredentialProvider struct {
+	configuration defaultConfiguration
+	mutex         *sync.Mutex
+}
+
+func (p tokenCredentialProvider) GetCredential(name string) (string, error) {
+	if name != ElixirAAIToken {
+		return "", nil
+	}
+	return p.token(context.Background(), "")
+}
+
+// token returns the cached access token, refreshing it if it is about to expire or if it is the rejected one.
+func (p tokenCredentialProvider) token(ctx context.Context, rejected string) (string, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	cache := p.configuration.tokenCache()
+	key := p.configuration.profileKey()
+	token, err := cache.Load(key)
+	if err != nil || token == nil {
+		return "", err
+	}
+	if token.Valid(tokenRefreshMargin) && token.AccessToken != rejected {
+		return token.AccessToken, nil
+	}
+	// The refresh token is only in the cache if it was written there before the credential store kept it.
+	if token.RefreshToken == "" {
+		if token.RefreshToken, err = p.configuration.credentialStore().secret(refreshTokenName(key)); err != nil {
+			return "", err
+		}
+	}
+	if token.RefreshToken == "" {
+		return "", errors.New("ELIXIR AAI token has expired, run login again")
+	}
+	provider, err := p.configuration.authProvider()
+	if err != nil {
+		return "", err
+	}
+	token, err = provider.Refresh(ctx, token.RefreshToken)
+	if err != nil {
+		return "", err
+	}
+	if err = p.configuration.storeToken(*token); err != nil {
+		return "", err
+	}
+	return token.AccessToken, nil
+}
+
+// RefreshElixirAAIToken refreshes the ELIXIR AAI token rejected by the server, if it was obtained with the login
+// command, even though it has not expired yet. It tells whether the token was refreshed, so that the rejected request
+// is worth repeating.
+func RefreshElixirAAIToken(ctx context.Context, rejected string) (bool, error) {
+	return NewConfiguration().(*defaultConfiguration).refreshElixirAAIToken(ctx, rejected)
+}
+
+func (dc defaultConfiguration) refreshElixirAAIToken(ctx context.Context, rejected string) (bool, error) {
+	for _, provider := range dc.credentialProviders() {
+		if tokenProvider, ok := provider.(tokenCredentialProvider); ok {
+			token, err := tokenProvider.token(ctx, rejected)
+			return err == nil && token != "" && token != rejected, err
+		}
+		secret, err := provider.GetCredential(ElixirAAIToken)
+		if err != nil || secret != "" {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+func (dc defaultConfiguration) authProvider() (auth.Provider, error) {
+	clientID := dc.value("oidc_client_id")
+	if clientID == "" {
+		return nil, errors.New("OIDC client ID is not set, use config set oidc_client_id")
+	}
+	client := requests.NewRetryingClient(nil, requests.NewRetryPolicy(dc.GetHTTPAttempts()))
+	return auth.NewProvider(&client, dc.value("oidc_issuer"), clientID, dc.value("oidc_scope"))
+}
+
+func (dc defaultConfiguration) tokenCache() *auth.TokenCache {
+	return auth.NewTokenCache(dc.value("token_cache"))
+}
@@ -2,11 +2,11 @@
 package files
 
 import (
+	"context"
 	"errors"
 	"io/ioutil"
 	"net/http"
 	"strconv"
-	"strings"
 
 	"github.com/buger/jsonparser"
 	"github.com/elixir-oslo/lega-commander/conf"
@@ -18,12 +18,14 @@ type File struct {
 	FileName     string
 	Size         int64
 	ModifiedDate string
+	// Checksum is the SHA-256 checksum of the file, empty if the server does not provide it.
+	Checksum string
 }
 
 // FileManager interface provides method for managing uploaded files.
 type FileManager interface {
-	ListFiles(inbox bool) (*[]File, error)
-	DeleteFile(fileName string) error
+	ListFiles(ctx context.Context, inbox bool) (*[]File, error)
+	DeleteFile(ctx context.Context, fileName string) error
 }
 
 type defaultFileManager struct {
@@ -32,12 +34,19 @@ type defaultFileManager struct {
 
 // Represents an error message to handle a missing or empty folder
 type FolderNotFoundError struct {
-    Msg string
+	Msg string
+	// Err is the error response of the server.
+	Err error
 }
 
 // Returns the error message in FolderNotFoundError.
 func (e *FolderNotFoundError) Error() string {
-    return e.Msg
+	return e.Msg
+}
+
+// Unwrap returns the error response of the server.
+func (e *FolderNotFoundError) Unwrap() error {
+	return e.Err
 }
 
 // NewFileManager constructs FileManager using requests.Client.
@@ -52,14 +61,14 @@ func NewFileManager(client *requests.Client) (FileManager, error) {
 }
 
 // ListFiles method lists uploaded files.
-func (rm defaultFileManager) ListFiles(inbox bool) (*[]File, error) {
+func (rm defaultFileManager) ListFiles(ctx context.Context, inbox bool) (*[]File, error) {
 	configuration := conf.NewConfiguration()
 	username, password := "", ""
 	if inbox {
 		username = configuration.GetCentralEGAUsername()
 		password = configuration.GetCentralEGAPassword()
 	}
-	response, err := rm.client.DoRequest(http.MethodGet,
+	response, err := rm.client.DoRequest(ctx, http.MethodGet,
 		configuration.GetLocalEGAInstanceURL()+"/files",
 		nil,
 		map[string]string{"Proxy-Authorization": "Bearer " + configuration.GetElixirAAIToken()},
@@ -69,20 +78,12 @@ func (rm defaultFileManager) ListFiles(inbox bool) (*[]File, error) {
 	if err != nil {
 		return nil, err
 	}
-	if response.StatusCode == 403 {
-    		body, err := ioutil.ReadAll(response.Body)
-    		if err != nil {
-    			return nil, errors.New("Failed to read the server's response")
-    		}
-    		// Check if the response body contains the specific error message indicating
-    		// that the folder is empty or doesn't exist yet.
-    		if strings.Contains(string(body), `"tsdFiles" is null`) {
-    			return nil, &FolderNotFoundError{}
-    		}
-    		// If it's not an empty folder, it's a genuine authentication error.
-    		return nil, errors.New("Authentication error")
-    	} else if response.StatusCode != 200 {
-    	return nil, errors.New(response.Status)
+	if err = requests.CheckResponse(response); err != nil {
+		var responseError *requests.ResponseError
+		if errors.As(err, &responseError) && isFolderNotFound(responseError) {
+			return nil, &FolderNotFoundError{Msg: responseError.Message, Err: responseError}
+		}
+		return nil, err
 	}
 	body, err := ioutil.ReadAll(response.Body)
 	if err != nil {
@@ -98,7 +99,8 @@ func (rm defaultFileManager) ListFiles(inbox bool) (*[]File, error) {
 			fileName, _ := jsonparser.GetString(value, "fileName")
 			size, _ := jsonparser.GetInt(value, "size")
 			modifiedDate, _ := jsonparser.GetString(value, "modifiedDate")
-			file := File{fileName, size, modifiedDate}
+			checksum, _ := jsonparser.GetString(value, "checksum")
+			file := File{fileName, size, modifiedDate, checksum}
 			files = append(files, file)
 		},
 		"files")
@@ -106,9 +108,9 @@ func (rm defaultFileManager) ListFiles(inbox bool) (*[]File, error) {
 }
 
 // DeleteFiles method deletes uploaded file by its name.
-func (rm defaultFileManager) DeleteFile(fileName string) error {
+func (rm defaultFileManager) DeleteFile(ctx context.Context, fileName string) error {
 	configuration := conf.NewConfiguration()
-	response, err := rm.client.DoRequest(http.MethodDelete,
+	response, err := rm.client.DoRequest(ctx, http.MethodDelete,
 		configuration.GetLocalEGAInstanceURL()+"/files",
 		nil,
 		map[string]string{"Proxy-Authorization": "Bearer " + configuration.GetElixirAAIToken()},
@@ -118,8 +120,16 @@ func (rm defaultFileManager) DeleteFile(fileName string) error {
 	if err != nil {
 		return err
 	}
-	if response.StatusCode != 200 {
-		return errors.New(response.Status)
-	}
-	return nil
+	return requests.CheckResponse(response)
+}
+
+// folderNotFoundMessage is the message of the failed TSD File API call the proxy forwards when the user folder is empty
+// or does not exist yet.
+const folderNotFoundMessage = `"tsdFiles" is null`
+
+// isFolderNotFound tells from the decoded 403 response whether the proxy refuses to list the files because the user
+// folder is empty or does not exist yet. The proxy gives no error code for it, so its message field is the only signal;
+// should the proxy reword it, the folder is reported as the plain 403 error.
+func isFolderNotFound(responseError *requests.ResponseError) bool {
+	return responseError.StatusCode == http.StatusForbidden && responseError.Message == folderNotFoundMessage
 }
@@ -1,6 +1,8 @@
 package files
 
 import (
+	"context"
+	"errors"
 	"github.com/elixir-oslo/lega-commander/requests"
 	"io"
 	"io/ioutil"
@@ -13,12 +15,12 @@ import (
 type mockClient struct {
 }
 
-func (mockClient) DoRequest(method, url string, _ io.Reader, _, params map[string]string, _, _ string) (*http.Response, error) {
+func (mockClient) DoRequest(_ context.Context, method, url string, _ io.Reader, _, params map[string]string, _, _ string) (*http.Response, error) {
 	if strings.HasSuffix(url, "/files") {
 		if method == http.MethodGet {
 			var body io.ReadCloser
 			if params["inbox"] == "" || params["inbox"] == "true" {
-				body = ioutil.NopCloser(strings.NewReader(`{"files": [{"fileName": "test.enc", "size": 100, "modifiedDate": "2010"}]}`))
+				body = ioutil.NopCloser(strings.NewReader(`{"files": [{"fileName": "test.enc", "size": 100, "modifiedDate": "2010", "checksum": "abc"}]}`))
 			} else {
 				body = ioutil.NopCloser(strings.NewReader(`{"files": [{"fileName": "test2.enc", "size": 100, "modifiedDate": "2010"}]}`))
 			}
@@ -50,7 +52,7 @@ func TestListFilesInbox(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	fileList, err := fileManager.ListFiles(true)
+	fileList, err := fileManager.ListFiles(context.Background(), true)
 	if err != nil {
 		t.Error(err)
 	}
@@ -58,7 +60,7 @@ func TestListFilesInbox(t *testing.T) {
 		t.Error()
 	}
 	file := (*fileList)[0]
-	if file.FileName != "test.enc" || file.Size != 100 || file.ModifiedDate != "2010" {
+	if file.FileName != "test.enc" || file.Size != 100 || file.ModifiedDate != "2010" || file.Checksum != "abc" {
 		t.Error()
 	}
 }
@@ -73,7 +75,7 @@ func TestListFilesOutbox(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	fileList, err := fileManager.ListFiles(false)
+	fileList, err := fileManager.ListFiles(context.Background(), false)
 	if err != nil {
 		t.Error(err)
 	}
@@ -81,7 +83,7 @@ func TestListFilesOutbox(t *testing.T) {
 		t.Error()
 	}
 	file := (*fileList)[0]
-	if file.FileName != "test2.enc" || file.Size != 100 || file.ModifiedDate != "2010" {
+	if file.FileName != "test2.enc" || file.Size != 100 || file.ModifiedDate != "2010" || file.Checksum != "" {
 		t.Error()
 	}
 }
@@ -96,7 +98,7 @@ func TestDeleteInboxFile200(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	err = fileManager.DeleteFile("test.enc")
+	err = fileManager.DeleteFile(context.Background(), "test.enc")
 	if err != nil {
 		t.Error(err)
 	}
@@ -112,8 +114,55 @@ func TestDeleteInboxFile500(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	err = fileManager.DeleteFile("12")
-	if err == nil {
+	err = fileManager.DeleteFile(context.Background(), "12")
+	if !errors.Is(err, requests.ErrServerError) {
 		t.Error(err)
 	}
 }
+
+type folderNotFoundClient struct {
+}
+
+func (folderNotFoundClient) DoRequest(_ context.Context, _, _ string, _ io.Reader, _, _ map[string]string, _, _ string) (*http.Response, error) {
+	body := ioutil.NopCloser(strings.NewReader(`{"status": 403, "error": "Forbidden", "message": "\"tsdFiles\" is null"}`))
+	response := http.Response{StatusCode: 403, Status: "403 Forbidden", Body: body}
+	return &response, nil
+}
+
+func TestListFilesFolderNotFound(t *testing.T) {
+	_ = os.Setenv("CENTRAL_EGA_USERNAME", "user")
+	_ = os.Setenv("CENTRAL_EGA_PASSWORD", "pass")
+	_ = os.Setenv("LOCAL_EGA_INSTANCE_URL", "http://localhost/")
+	_ = os.Setenv("ELIXIR_AAI_TOKEN", "token")
+	var client requests.Client = folderNotFoundClient{}
+	fileManager, err := NewFileManager(&client)
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = fileManager.ListFiles(context.Background(), true)
+	var folderNotFoundError *FolderNotFoundError
+	if !errors.As(err, &folderNotFoundError) || !errors.Is(err, requests.ErrForbidden) {
+		t.Error(err)
+	}
+}
+
+func TestIsFolderNotFound(t *testing.T) {
+	for body, folderNotFound := range map[string]bool{
+		`{"status": 403, "error": "Forbidden", "message": "\"tsdFiles\" is null"}`:  true,
+		`{"status": 403, "error": "Forbidden", "message": "Access denied"}`:         false,
+		`{"status": 403, "error": "Forbidden", "message": "\"tsdFiles\" is null!"}`: false,
+		``: false,
+	} {
+		response := http.Response{StatusCode: http.StatusForbidden, Body: ioutil.NopCloser(strings.NewReader(body))}
+		if isFolderNotFound(requests.NewResponseError(&response)) != folderNotFound {
+			t.Error(body)
+		}
+	}
+	response := http.Response{
+		StatusCode: http.StatusNotFound,
+		Body:       ioutil.NopCloser(strings.NewReader(`{"message": "\"tsdFiles\" is null"}`)),
+	}
+	if isFolderNotFound(requests.NewResponseError(&response)) {
+		t.Error(response.StatusCode)
+	}
+}
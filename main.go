@@ -4,18 +4,29 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"text/tabwriter"
+	"time"
 
+	"github.com/elixir-oslo/lega-commander/auth"
+	"github.com/elixir-oslo/lega-commander/c4gh"
+	"github.com/elixir-oslo/lega-commander/conf"
 	"github.com/elixir-oslo/lega-commander/files"
+	"github.com/elixir-oslo/lega-commander/requests"
 	"github.com/elixir-oslo/lega-commander/resuming"
 	"github.com/elixir-oslo/lega-commander/streaming"
 	"github.com/jessevdk/go-flags"
 	aurora "github.com/logrusorgru/aurora/v3"
+	"github.com/neicnordic/crypt4gh/model/headers"
 )
 
 var (
@@ -24,11 +35,18 @@ var (
 )
 
 const (
-	inboxCommand      = "inbox"
-	outboxCommand     = "outbox"
-	resumablesCommand = "resumables"
-	uploadCommand     = "upload"
-	downloadCommand   = "download"
+	inboxCommand       = "inbox"
+	outboxCommand      = "outbox"
+	resumablesCommand  = "resumables"
+	uploadCommand      = "upload"
+	downloadCommand    = "download"
+	verifyCommand      = "verify"
+	inspectCommand     = "inspect"
+	reencryptCommand   = "reencrypt"
+	keysCommand        = "keys"
+	configCommand      = "config"
+	credentialsCommand = "credentials"
+	loginCommand       = "login"
 )
 
 var inboxOptions struct {
@@ -45,27 +63,113 @@ var outboxOptions struct {
 var outboxOptionsParser = flags.NewParser(&outboxOptions, flags.None)
 
 var resumablesOptions struct {
-	List   bool   `short:"l" long:"list" description:"Lists resumable uploads"`
-	Delete string `short:"d" long:"delete" description:"Deletes resumable upload by ID"`
+	List     bool     `short:"l" long:"list" description:"Lists resumable uploads"`
+	Delete   string   `short:"d" long:"delete" description:"Deletes resumable upload by ID"`
+	From     []string `long:"from" description:"Folder to look for the files of the uploads to resume in, searched recursively (can be repeated)" value-name:"FOLDER"`
+	Parallel int      `short:"p" long:"parallel" description:"Number of uploads to resume at once" value-name:"N" default:"1"`
+	Straight bool     `short:"b" long:"beta" description:"Resumes the uploads without the proxy service;i.e. directly to tsd file api"`
+	NoVerify bool     `long:"no-verify" description:"Skips checking the resumed files against the inbox"`
 }
 
 var resumablesOptionsParser = flags.NewParser(&resumablesOptions, flags.None)
 
 var uploadingOptions struct {
-	FileName string `short:"f"  long:"file" description:"File or folder to upload" value-name:"FILE" required:"true"`
-	Resume   bool   `short:"r" long:"resume" description:"Resumes interrupted upload"`
-	Straight bool   `short:"b" long:"beta" description:"Upload the files without the proxy service;i.e. directly to tsd file api"`
+	FileName         string   `short:"f"  long:"file" description:"File or folder to upload" value-name:"FILE" required:"true"`
+	Resume           bool     `short:"r" long:"resume" description:"Resumes interrupted upload"`
+	Straight         bool     `short:"b" long:"beta" description:"Upload the files without the proxy service;i.e. directly to tsd file api"`
+	Parallel         int      `short:"p" long:"parallel" description:"Number of files of a folder to upload at once" value-name:"N" default:"1"`
+	Recursive        bool     `short:"R" long:"recursive" description:"Keeps the paths of the files relative to the folder as their names in the inbox"`
+	Prefix           string   `long:"prefix" description:"Prefix to prepend to the file names in the inbox" value-name:"PREFIX"`
+	Include          []string `long:"include" description:"Uploads only files of a folder matching the glob pattern (can be repeated)" value-name:"PATTERN"`
+	Exclude          []string `long:"exclude" description:"Skips files and subfolders of a folder matching the glob pattern (can be repeated)" value-name:"PATTERN"`
+	NoVerify         bool     `long:"no-verify" description:"Skips checking the uploaded files against the inbox"`
+	Manifest         string   `short:"m" long:"manifest" description:"Writes checksums of the uploaded files to MANIFEST.json and MANIFEST.tsv" value-name:"MANIFEST"`
+	Encrypt          bool     `short:"e" long:"encrypt" description:"Encrypts plaintext files during the upload, adding .c4gh suffix to their names"`
+	PublicKey        string   `long:"pubkey" description:"Public key of the recipient to encrypt the files for, the ingestion key by default" value-name:"KEY"`
+	WriterSeckey     []string `long:"writer-seckey" description:"Private key the files were encrypted with, to check they are encrypted for the ingestion key (can be repeated)" value-name:"KEY"`
+	NoRecipientCheck bool     `long:"no-recipient-check" description:"Skips checking the files are encrypted for the ingestion key"`
 }
 
 var uploadingOptionsParser = flags.NewParser(&uploadingOptions, flags.None)
 
 var downloadingOptions struct {
 	FileName string `short:"f"  long:"file" description:"File to download\t[optional]"`
+	Resume   bool   `short:"r" long:"resume" description:"Resumes interrupted download"`
+	Decrypt  bool   `short:"d" long:"decrypt" description:"Decrypts the files during the download, stripping .c4gh suffix from their names"`
+	Seckey   string `long:"seckey" description:"Private key to decrypt the files with" value-name:"KEY"`
 	Straight bool   `short:"b" long:"beta" description:"download the files without the proxy service;i.e. directly from tsd file api"`
 }
 
 var downloadingOptionsParser = flags.NewParser(&downloadingOptions, flags.None)
 
+var verifyingOptions struct {
+	FileName  string   `short:"f"  long:"file" description:"Uploaded file or folder to check against the inbox" value-name:"FILE" required:"true"`
+	Recursive bool     `short:"R" long:"recursive" description:"Checks the files under their paths relative to the folder, as uploaded with --recursive"`
+	Prefix    string   `long:"prefix" description:"Prefix the file names in the inbox were uploaded with" value-name:"PREFIX"`
+	Include   []string `long:"include" description:"Checks only files of a folder matching the glob pattern (can be repeated)" value-name:"PATTERN"`
+	Exclude   []string `long:"exclude" description:"Skips files and subfolders of a folder matching the glob pattern (can be repeated)" value-name:"PATTERN"`
+}
+
+var verifyingOptionsParser = flags.NewParser(&verifyingOptions, flags.None)
+
+var inspectingOptions struct {
+	FileName string   `short:"f"  long:"file" description:"Local Crypt4GH file to inspect" value-name:"FILE" required:"true"`
+	Seckey   []string `long:"seckey" description:"Private key to decrypt the header packets with (can be repeated)" value-name:"KEY"`
+}
+
+var inspectingOptionsParser = flags.NewParser(&inspectingOptions, flags.None)
+
+var reencryptingOptions struct {
+	FileName  string   `short:"f"  long:"file" description:"Local Crypt4GH file to re-encrypt" value-name:"FILE" required:"true"`
+	Output    string   `short:"o" long:"output" description:"File to write the re-encrypted copy to" value-name:"FILE" required:"true"`
+	Seckey    string   `long:"seckey" description:"Private key the file is encrypted for" value-name:"KEY" required:"true"`
+	PublicKey []string `long:"pubkey" description:"Public key of the new recipient (can be repeated)" value-name:"KEY" required:"true"`
+}
+
+var reencryptingOptionsParser = flags.NewParser(&reencryptingOptions, flags.None)
+
+var keysOptions struct {
+	Name string `short:"n" long:"name" description:"Name of the key pair to generate or show, all the key pairs are listed by show without it" value-name:"NAME"`
+	Key  string `short:"k" long:"key" description:"Public or private key to print the fingerprint of" value-name:"KEY"`
+}
+
+var keysOptionsParser = flags.NewParser(&keysOptions, flags.None)
+
+var configOptionsParser = flags.NewParser(&struct{}{}, flags.None)
+
+var credentialsOptionsParser = flags.NewParser(&struct{}{}, flags.None)
+
+var loginOptions struct {
+	Status bool `short:"s" long:"status" description:"Shows whether the user is logged in and when the token expires"`
+	Logout bool `long:"logout" description:"Removes the cached tokens"`
+}
+
+var loginOptionsParser = flags.NewParser(&loginOptions, flags.None)
+
+var configurationOptions struct {
+	Config      string `long:"config" description:"Configuration file to use instead of the default one" value-name:"FILE"`
+	Profile     string `long:"profile" description:"Profile of the configuration file to use" value-name:"PROFILE"`
+	InstanceURL string `long:"instance-url" description:"URL of the LocalEGA instance" value-name:"URL"`
+	TSDBaseURL  string `long:"tsd-url" description:"Base URL of the TSD file API" value-name:"URL"`
+	TSDProject  string `long:"tsd-project" description:"Name of the TSD project" value-name:"PROJECT"`
+	ChunkSize   string `long:"chunk-size" description:"Size of the uploaded chunks in megabytes" value-name:"MB"`
+}
+
+var configurationOptionsParser = flags.NewParser(&configurationOptions, flags.IgnoreUnknown)
+
+func init() {
+	parsers := []*flags.Parser{inboxOptionsParser, outboxOptionsParser, resumablesOptionsParser, uploadingOptionsParser,
+		downloadingOptionsParser, verifyingOptionsParser, inspectingOptionsParser, reencryptingOptionsParser,
+		keysOptionsParser, configOptionsParser, credentialsOptionsParser, loginOptionsParser}
+	for _, parser := range parsers {
+		group, err := parser.AddGroup("Configuration Options", "", &configurationOptions)
+		if err != nil {
+			log.Fatal(aurora.Red(err))
+		}
+		group.Hidden = true
+	}
+}
+
 const (
 	usageString        = "Usage:\n  lega-commander\n"
 	applicationOptions = "Application Options"
@@ -82,11 +186,31 @@ func main() {
 		fmt.Println(aurora.Yellow(date))
 		os.Exit(0)
 	}
-	fileManager, err := files.NewFileManager(nil)
-	if err != nil {
+	if _, err := configurationOptionsParser.Parse(); err != nil {
 		log.Fatal(aurora.Red(err))
 	}
+	for name, value := range map[string]string{
+		"config":       configurationOptions.Config,
+		"profile":      configurationOptions.Profile,
+		"instance_url": configurationOptions.InstanceURL,
+		"tsd_base_url": configurationOptions.TSDBaseURL,
+		"tsd_project":  configurationOptions.TSDProject,
+		"chunk_size":   configurationOptions.ChunkSize,
+	} {
+		if value != "" {
+			conf.SetFlag(name, value)
+		}
+	}
 	commandName := args[1]
+	client := requests.NewClient(nil)
+	if commandName != configCommand {
+		client = requests.NewRetryingClient(nil, requests.NewRetryPolicy(conf.NewConfiguration().GetHTTPAttempts()))
+	}
+	ctx := interruptibleContext()
+	fileManager, err := files.NewFileManager(&client)
+	if err != nil {
+		log.Fatal(aurora.Red(err))
+	}
 	switch commandName {
 	case inboxCommand:
 		_, err := inboxOptionsParser.Parse()
@@ -94,12 +218,11 @@ func main() {
 			log.Fatal(aurora.Red(err))
 		}
 		if inboxOptions.List {
-			fileList, err := fileManager.ListFiles(true)
-			if err != nil {
-                    if _, ok := err.(*files.FolderNotFoundError); ok {
-                        log.Fatal(aurora.Red("Inbox Error: The user folder is empty or does not exist yet"))
-                    }
-                }
+			fileList, err := fileManager.ListFiles(ctx, true)
+			var folderNotFoundError *files.FolderNotFoundError
+			if errors.As(err, &folderNotFoundError) {
+				log.Fatal(aurora.Red("Inbox Error: The user folder is empty or does not exist yet"))
+			}
 			if err != nil {
 				log.Fatal(aurora.Red(err))
 			}
@@ -119,7 +242,7 @@ func main() {
 				log.Fatal(aurora.Red(err))
 			}
 		} else if inboxOptions.Delete != "" {
-			err = fileManager.DeleteFile(inboxOptions.Delete)
+			err = fileManager.DeleteFile(ctx, inboxOptions.Delete)
 			if err != nil {
 				log.Fatal(aurora.Red(err))
 			} else {
@@ -134,12 +257,11 @@ func main() {
 			log.Fatal(aurora.Red(err))
 		}
 		if inboxOptions.List {
-			fileList, err := fileManager.ListFiles(false)
-			if err != nil {
-                    if _, ok := err.(*files.FolderNotFoundError); ok {
-                        log.Fatal(aurora.Red("Outbox Error: No data has been staged in the outbox yet"))
-                    }
-                }
+			fileList, err := fileManager.ListFiles(ctx, false)
+			var folderNotFoundError *files.FolderNotFoundError
+			if errors.As(err, &folderNotFoundError) {
+				log.Fatal(aurora.Red("Outbox Error: No data has been staged in the outbox yet"))
+			}
 			if err != nil {
 				log.Fatal(aurora.Red(err))
 			}
@@ -159,7 +281,7 @@ func main() {
 				log.Fatal(aurora.Red(err))
 			}
 		} else if inboxOptions.Delete != "" {
-			err = fileManager.DeleteFile(inboxOptions.Delete)
+			err = fileManager.DeleteFile(ctx, inboxOptions.Delete)
 			if err != nil {
 				log.Fatal(aurora.Red(err))
 			} else {
@@ -169,16 +291,35 @@ func main() {
 			log.Fatal(aurora.Red("none of the flags are selected"))
 		}
 	case resumablesCommand:
-		_, err := resumablesOptionsParser.Parse()
+		args, err := resumablesOptionsParser.Parse()
 		if err != nil {
 			log.Fatal(aurora.Red(err))
 		}
-		resumablesManager, err := resuming.NewResumablesManager(nil)
+		action := ""
+		if len(args) > 1 {
+			action = args[1]
+		}
+		resumablesManager, err := resuming.NewResumablesManager(&client)
 		if err != nil {
 			log.Fatal(aurora.Red(err))
 		}
-		if resumablesOptions.List {
-			resumables, err := resumablesManager.ListResumables()
+		if action == "resume-all" {
+			streamer, err := streaming.NewStreamer(ctx, &client, nil, &resumablesManager, resumablesOptions.Straight)
+			if err != nil {
+				log.Fatal(aurora.Red(err))
+			}
+			err = streamer.ResumeAll(ctx, resumablesOptions.From, streaming.UploadOptions{
+				Straight: resumablesOptions.Straight,
+				Parallel: resumablesOptions.Parallel,
+				Verify:   !resumablesOptions.NoVerify,
+			})
+			if err != nil {
+				log.Fatal(aurora.Red(err))
+			}
+		} else if action != "" {
+			log.Fatal(aurora.Red("action is not recognized, use resumables resume-all"))
+		} else if resumablesOptions.List {
+			resumables, err := resumablesManager.ListResumables(ctx)
 			if err != nil {
 				log.Fatal(aurora.Red(err))
 			}
@@ -198,7 +339,7 @@ func main() {
 				log.Fatal(aurora.Red(err))
 			}
 		} else if resumablesOptions.Delete != "" {
-			err = resumablesManager.DeleteResumable(resumablesOptions.Delete)
+			err = resumablesManager.DeleteResumable(ctx, resumablesOptions.Delete)
 			if err != nil {
 				log.Fatal(aurora.Red(err))
 			} else {
@@ -212,11 +353,33 @@ func main() {
 		if err != nil {
 			log.Fatal(aurora.Red(err))
 		}
-		streamer, err := streaming.NewStreamer(nil, nil, nil, uploadingOptions.Straight)
+		var writerPrivateKeys [][32]byte
+		for _, seckey := range uploadingOptions.WriterSeckey {
+			privateKey, err := c4gh.ReadPrivateKey(privateKeyPath(seckey))
+			if err != nil {
+				log.Fatal(aurora.Red(err))
+			}
+			writerPrivateKeys = append(writerPrivateKeys, *privateKey)
+		}
+		streamer, err := streaming.NewStreamer(ctx, &client, nil, nil, uploadingOptions.Straight)
 		if err != nil {
 			log.Fatal(aurora.Red(err))
 		}
-		err = streamer.Upload(uploadingOptions.FileName, uploadingOptions.Resume, uploadingOptions.Straight)
+		err = streamer.Upload(ctx, uploadingOptions.FileName, streaming.UploadOptions{
+			Resume:             uploadingOptions.Resume,
+			Straight:           uploadingOptions.Straight,
+			Parallel:           uploadingOptions.Parallel,
+			Recursive:          uploadingOptions.Recursive,
+			Prefix:             uploadingOptions.Prefix,
+			Include:            uploadingOptions.Include,
+			Exclude:            uploadingOptions.Exclude,
+			Verify:             !uploadingOptions.NoVerify,
+			Manifest:           uploadingOptions.Manifest,
+			Encrypt:            uploadingOptions.Encrypt,
+			PublicKey:          publicKeyPath(uploadingOptions.PublicKey),
+			WriterPrivateKeys:  writerPrivateKeys,
+			SkipRecipientCheck: uploadingOptions.NoRecipientCheck,
+		})
 		if err != nil {
 			log.Fatal(aurora.Red(err))
 		}
@@ -225,35 +388,402 @@ func main() {
 		if err != nil {
 			log.Fatal(aurora.Red(err))
 		}
-		streamer, err := streaming.NewStreamer(nil, nil, nil, downloadingOptions.Straight)
+		streamer, err := streaming.NewStreamer(ctx, &client, nil, nil, downloadingOptions.Straight)
 		if err != nil {
 			log.Fatal(aurora.Red(err))
 		}
+		downloadOptions := streaming.DownloadOptions{Resume: downloadingOptions.Resume}
+		if downloadingOptions.Decrypt {
+			if downloadingOptions.Seckey == "" {
+				log.Fatal(aurora.Red("private key is required for decryption, use --seckey"))
+			}
+			downloadOptions.PrivateKey, err = c4gh.ReadPrivateKey(privateKeyPath(downloadingOptions.Seckey))
+			if err != nil {
+				log.Fatal(aurora.Red(err))
+			}
+		}
 		if downloadingOptions.FileName == "" {
 			fmt.Println(aurora.Blue("File to export is not specified. Downloading the whole outbox folder."))
-			fileList, err := fileManager.ListFiles(false)
+			fileList, err := fileManager.ListFiles(ctx, false)
 			if err != nil {
 				log.Fatal(aurora.Red(err))
 			}
 			for _, file := range *fileList {
-				err = streamer.Download(file.FileName)
+				err = streamer.Download(ctx, file.FileName, downloadOptions)
 				if err != nil {
 					log.Fatal(aurora.Red(err))
 				}
 			}
 		} else {
-			err = streamer.Download(downloadingOptions.FileName)
+			err = streamer.Download(ctx, downloadingOptions.FileName, downloadOptions)
+			if err != nil {
+				log.Fatal(aurora.Red(err))
+			}
+		}
+	case verifyCommand:
+		_, err := verifyingOptionsParser.Parse()
+		if err != nil {
+			log.Fatal(aurora.Red(err))
+		}
+		streamer, err := streaming.NewStreamer(ctx, &client, nil, nil, false)
+		if err != nil {
+			log.Fatal(aurora.Red(err))
+		}
+		err = streamer.Verify(ctx, verifyingOptions.FileName, streaming.UploadOptions{
+			Recursive: verifyingOptions.Recursive,
+			Prefix:    verifyingOptions.Prefix,
+			Include:   verifyingOptions.Include,
+			Exclude:   verifyingOptions.Exclude,
+		})
+		if err != nil {
+			log.Fatal(aurora.Red(err))
+		}
+	case inspectCommand:
+		_, err := inspectingOptionsParser.Parse()
+		if err != nil {
+			log.Fatal(aurora.Red(err))
+		}
+		var privateKeys [][32]byte
+		for _, seckey := range inspectingOptions.Seckey {
+			privateKey, err := c4gh.ReadPrivateKey(privateKeyPath(seckey))
+			if err != nil {
+				log.Fatal(aurora.Red(err))
+			}
+			privateKeys = append(privateKeys, *privateKey)
+		}
+		header, err := c4gh.InspectFile(inspectingOptions.FileName, privateKeys...)
+		if err != nil {
+			log.Fatal(aurora.Red(err))
+		}
+		printHeader(inspectingOptions.FileName, header)
+	case reencryptCommand:
+		_, err := reencryptingOptionsParser.Parse()
+		if err != nil {
+			log.Fatal(aurora.Red(err))
+		}
+		privateKey, err := c4gh.ReadPrivateKey(privateKeyPath(reencryptingOptions.Seckey))
+		if err != nil {
+			log.Fatal(aurora.Red(err))
+		}
+		var recipients [][32]byte
+		for _, pubkey := range reencryptingOptions.PublicKey {
+			publicKey, err := c4gh.ReadPublicKey(publicKeyPath(pubkey))
+			if err != nil {
+				log.Fatal(aurora.Red(err))
+			}
+			recipients = append(recipients, *publicKey)
+		}
+		err = c4gh.ReencryptFile(reencryptingOptions.FileName, reencryptingOptions.Output, *privateKey, recipients)
+		if err != nil {
+			log.Fatal(aurora.Red(err))
+		}
+		fmt.Println(aurora.Green("Success"))
+	case keysCommand:
+		args, err := keysOptionsParser.Parse()
+		if err != nil {
+			log.Fatal(aurora.Red(err))
+		}
+		keysDirectory := conf.NewConfiguration().GetKeysDirectory()
+		action := ""
+		if len(args) > 1 {
+			action = args[1]
+		}
+		switch action {
+		case "generate":
+			if keysOptions.Name == "" {
+				log.Fatal(aurora.Red("name of the key pair is required, use -n"))
+			}
+			passphrase, err := c4gh.NewPassphrase(keysOptions.Name)
+			if err != nil {
+				log.Fatal(aurora.Red(err))
+			}
+			key, err := c4gh.GenerateKey(keysDirectory, keysOptions.Name, passphrase)
+			if err != nil {
+				log.Fatal(aurora.Red(err))
+			}
+			printKey(key)
+		case "show":
+			if keysOptions.Name != "" {
+				key, err := c4gh.GetKey(keysDirectory, keysOptions.Name)
+				if err != nil {
+					log.Fatal(aurora.Red(err))
+				}
+				printKey(key)
+				break
+			}
+			keyList, err := c4gh.ListKeys(keysDirectory)
+			if err != nil {
+				log.Fatal(aurora.Red(err))
+			}
+			tw := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.TabIndent)
+			_, err = fmt.Fprintln(tw, aurora.Blue("Key name\t Fingerprint"))
+			if err != nil {
+				log.Fatal(aurora.Red(err))
+			}
+			for _, key := range keyList {
+				_, err = fmt.Fprintln(tw, aurora.Blue(key.Name+"\t "+c4gh.Fingerprint(key.PublicKey)))
+				if err != nil {
+					log.Fatal(aurora.Red(err))
+				}
+			}
+			err = tw.Flush()
+			if err != nil {
+				log.Fatal(aurora.Red(err))
+			}
+		case "fingerprint":
+			if keysOptions.Key == "" {
+				log.Fatal(aurora.Red("key is required, use -k"))
+			}
+			publicKey, err := c4gh.ReadKeyPublicPart(publicKeyPath(keysOptions.Key))
 			if err != nil {
 				log.Fatal(aurora.Red(err))
 			}
+			fmt.Println(aurora.Blue(c4gh.Fingerprint(*publicKey)))
+		default:
+			log.Fatal(aurora.Red("action is not recognized, use keys generate, keys show or keys fingerprint"))
 		}
+	case configCommand:
+		args, err := configOptionsParser.Parse()
+		if err != nil {
+			log.Fatal(aurora.Red(err))
+		}
+		action := ""
+		if len(args) > 1 {
+			action = args[1]
+		}
+		switch action {
+		case "show":
+			settings, err := conf.Settings()
+			if err != nil {
+				log.Fatal(aurora.Red(err))
+			}
+			fmt.Println(aurora.Blue("Configuration file: " + conf.GetConfigurationFilePath()))
+			if profile := conf.NewConfiguration().GetProfile(); profile != "" {
+				fmt.Println(aurora.Blue("Profile: " + profile))
+			}
+			tw := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.TabIndent)
+			_, err = fmt.Fprintln(tw, aurora.Blue("Setting\t Value\t Source"))
+			if err != nil {
+				log.Fatal(aurora.Red(err))
+			}
+			for _, setting := range settings {
+				_, err = fmt.Fprintln(tw, aurora.Blue(setting.Name+"\t "+setting.Value+"\t "+setting.Source))
+				if err != nil {
+					log.Fatal(aurora.Red(err))
+				}
+			}
+			err = tw.Flush()
+			if err != nil {
+				log.Fatal(aurora.Red(err))
+			}
+		case "set":
+			if len(args) != 4 {
+				log.Fatal(aurora.Red("setting name and value are required, use config set NAME VALUE"))
+			}
+			err = conf.SetSetting(args[2], args[3])
+			if err != nil {
+				log.Fatal(aurora.Red(err))
+			}
+			fmt.Println(aurora.Green("Success"))
+		case "profiles":
+			profiles, err := conf.Profiles()
+			if err != nil {
+				log.Fatal(aurora.Red(err))
+			}
+			for _, profile := range profiles {
+				fmt.Println(aurora.Blue(profile))
+			}
+		case "validate":
+			err = conf.ValidateSettings()
+			if err != nil {
+				log.Fatal(aurora.Red(err))
+			}
+			fmt.Println(aurora.Green("Configuration is valid"))
+		default:
+			log.Fatal(aurora.Red("action is not recognized, use config show, config set, config profiles or config validate"))
+		}
+	case credentialsCommand:
+		args, err := credentialsOptionsParser.Parse()
+		if err != nil {
+			log.Fatal(aurora.Red(err))
+		}
+		action := ""
+		if len(args) > 1 {
+			action = args[1]
+		}
+		store := conf.NewCredentialStore()
+		switch action {
+		case "set":
+			if len(args) != 3 {
+				log.Fatal(aurora.Red("credential name is required, use credentials set NAME"))
+			}
+			secret, err := conf.ReadCredential(args[2])
+			if err != nil {
+				log.Fatal(aurora.Red(err))
+			}
+			if secret == "" {
+				log.Fatal(aurora.Red("credential can not be empty, use credentials delete NAME to remove it"))
+			}
+			err = store.SetCredential(args[2], secret)
+			if err != nil {
+				log.Fatal(aurora.Red(err))
+			}
+			fmt.Println(aurora.Green("Success"))
+		case "delete":
+			if len(args) != 3 {
+				log.Fatal(aurora.Red("credential name is required, use credentials delete NAME"))
+			}
+			err = store.DeleteCredential(args[2])
+			if err != nil {
+				log.Fatal(aurora.Red(err))
+			}
+			fmt.Println(aurora.Green("Success"))
+		case "list":
+			names, err := store.ListCredentials()
+			if err != nil {
+				log.Fatal(aurora.Red(err))
+			}
+			for _, name := range names {
+				fmt.Println(aurora.Blue(name))
+			}
+		default:
+			log.Fatal(aurora.Red("action is not recognized, use credentials set, credentials delete or credentials list"))
+		}
+	case loginCommand:
+		_, err := loginOptionsParser.Parse()
+		if err != nil {
+			log.Fatal(aurora.Red(err))
+		}
+		if loginOptions.Logout {
+			err = conf.Logout()
+			if err != nil {
+				log.Fatal(aurora.Red(err))
+			}
+			fmt.Println(aurora.Green("Success"))
+			break
+		}
+		if loginOptions.Status {
+			token, err := conf.CachedToken()
+			if err != nil {
+				log.Fatal(aurora.Red(err))
+			}
+			if token == nil {
+				log.Fatal(aurora.Red("Not logged in, use login"))
+			}
+			printToken(token)
+			break
+		}
+		token, err := conf.Login(ctx, func(authorization auth.DeviceAuthorization) {
+			if authorization.VerificationURIComplete != "" {
+				fmt.Println(aurora.Yellow("Open " + authorization.VerificationURIComplete + " to log in"))
+			} else {
+				fmt.Println(aurora.Yellow("Open " + authorization.VerificationURI + " and enter the code " + authorization.UserCode))
+			}
+			fmt.Println(aurora.Yellow("Waiting for the authorization..."))
+		})
+		if err != nil {
+			log.Fatal(aurora.Red(err))
+		}
+		fmt.Println(aurora.Green("Success"))
+		printToken(token)
 	default:
 		log.Fatal(aurora.Red(fmt.Sprintf("command '%v' is not recognized", commandName)))
 	}
 }
 
+// interruptibleContext returns the context that is cancelled on the first SIGINT or SIGTERM, letting the transfers stop
+// cleanly. The signals are handled the default way afterwards, so that the second one terminates the program at once.
+func interruptibleContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		signal.Stop(signals)
+		fmt.Fprintln(os.Stderr, aurora.Yellow("Interrupted, stopping after the chunks being sent; interrupt again to abort"))
+		cancel()
+	}()
+	return ctx
+}
+
+// printToken prints when the cached token expires and whether it can be refreshed.
+func printToken(token *auth.Token) {
+	if token.Expiry.IsZero() {
+		fmt.Println(aurora.Blue("Token expires: never"))
+	} else {
+		fmt.Println(aurora.Blue("Token expires: " + token.Expiry.Local().Format(time.RFC1123)))
+	}
+	fmt.Println(aurora.Blue("Refreshable: " + strconv.FormatBool(token.RefreshToken != "")))
+}
+
+// printKey prints the paths, the public key and the fingerprint of the key pair.
+func printKey(key *c4gh.Key) {
+	fmt.Println(aurora.Blue("Key name: " + key.Name))
+	fmt.Println(aurora.Blue("Public key: " + key.PublicKeyPath))
+	fmt.Println(aurora.Blue("Private key: " + key.PrivateKeyPath))
+	fmt.Println(aurora.Blue("Fingerprint: " + c4gh.Fingerprint(key.PublicKey)))
+	content, err := os.ReadFile(key.PublicKeyPath)
+	if err != nil {
+		log.Fatal(aurora.Red(err))
+	}
+	fmt.Print(string(content))
+}
+
+// publicKeyPath resolves the public key given either by its path or by its name in the key directory.
+func publicKeyPath(reference string) string {
+	if reference == "" {
+		return ""
+	}
+	return c4gh.PublicKeyPath(conf.NewConfiguration().GetKeysDirectory(), reference)
+}
+
+// privateKeyPath resolves the private key given either by its path or by its name in the key directory.
+func privateKeyPath(reference string) string {
+	return c4gh.PrivateKeyPath(conf.NewConfiguration().GetKeysDirectory(), reference)
+}
+
+// printHeader prints the details of the Crypt4GH header of the file.
+func printHeader(fileName string, header *c4gh.Header) {
+	fmt.Println(aurora.Blue("File: " + fileName))
+	fmt.Println(aurora.Blue("Crypt4GH version: " + strconv.FormatUint(uint64(header.Version), 10)))
+	fmt.Println(aurora.Blue("Header size: " + strconv.Itoa(header.Size) + " bytes"))
+	fmt.Println(aurora.Blue("Header packets: " + strconv.Itoa(len(header.Packets))))
+	for i, packet := range header.Packets {
+		method := "unknown encryption method " + strconv.FormatUint(uint64(packet.EncryptionMethod), 10)
+		if packet.EncryptionMethod == headers.X25519ChaCha20IETFPoly1305 {
+			method = "X25519-ChaCha20-IETF-Poly1305"
+		}
+		fmt.Println(aurora.Blue("Packet " + strconv.Itoa(i+1) + ": " + strconv.FormatUint(uint64(packet.Length), 10) +
+			" bytes, " + method))
+		fmt.Println(aurora.Blue("  Writer public key: " + base64.StdEncoding.EncodeToString(packet.WriterPublicKey[:]) +
+			" (" + c4gh.Fingerprint(packet.WriterPublicKey) + ")"))
+		if !packet.Decrypted() {
+			fmt.Println(aurora.Yellow("  Recipient: unknown, none of the given private keys decrypts the packet"))
+			continue
+		}
+		fmt.Println(aurora.Green("  Recipient: " + base64.StdEncoding.EncodeToString(packet.Recipient[:]) +
+			" (" + c4gh.Fingerprint(*packet.Recipient) + ")"))
+		switch packet.Type {
+		case headers.DataEncryptionParameters:
+			method := "unknown method " + strconv.FormatUint(uint64(packet.DataEncryptionMethod), 10)
+			if packet.DataEncryptionMethod == headers.ChaCha20IETFPoly1305 {
+				method = "ChaCha20-IETF-Poly1305"
+			}
+			fmt.Println(aurora.Blue("  Type: data encryption parameters, " + method))
+		case headers.DataEditList:
+			lengths := make([]string, len(packet.DataEditList))
+			for j, length := range packet.DataEditList {
+				lengths[j] = strconv.FormatUint(length, 10)
+			}
+			fmt.Println(aurora.Blue("  Type: data edit list, lengths " + strings.Join(lengths, ", ")))
+		default:
+			fmt.Println(aurora.Blue("  Type: unknown " + strconv.FormatUint(uint64(packet.Type), 10)))
+		}
+	}
+}
+
 func generateHelpMessage() string {
-	header := "lega-commander [inbox | outbox | resumables | upload | download] <args>\n"
+	header := "lega-commander [inbox | outbox | resumables | upload | download | verify | inspect | reencrypt | keys | config | credentials | login] <args>\n"
 
 	buf := bytes.Buffer{}
 	inboxOptionsParser.WriteHelp(&buf)
@@ -271,7 +801,7 @@ func generateHelpMessage() string {
 	resumablesOptionsParser.WriteHelp(&buf)
 	resumablesUsage := buf.String()
 	resumablesUsage = strings.Replace(resumablesUsage, usageString, "", 1)
-	resumablesUsage = strings.Replace(resumablesUsage, applicationOptions, " "+resumablesCommand, 1)
+	resumablesUsage = strings.Replace(resumablesUsage, applicationOptions, " "+resumablesCommand+" [resume-all]", 1)
 
 	buf.Reset()
 	uploadingOptionsParser.WriteHelp(&buf)
@@ -285,5 +815,46 @@ func generateHelpMessage() string {
 	downloadingUsage = strings.Replace(downloadingUsage, usageString, "", 1)
 	downloadingUsage = strings.Replace(downloadingUsage, applicationOptions, " "+downloadCommand, 1)
 
-	return header + inboxUsage + outboxUsage + resumablesUsage + uploadingUsage + downloadingUsage
+	buf.Reset()
+	verifyingOptionsParser.WriteHelp(&buf)
+	verifyingUsage := buf.String()
+	verifyingUsage = strings.Replace(verifyingUsage, usageString, "", 1)
+	verifyingUsage = strings.Replace(verifyingUsage, applicationOptions, " "+verifyCommand, 1)
+
+	buf.Reset()
+	inspectingOptionsParser.WriteHelp(&buf)
+	inspectingUsage := buf.String()
+	inspectingUsage = strings.Replace(inspectingUsage, usageString, "", 1)
+	inspectingUsage = strings.Replace(inspectingUsage, applicationOptions, " "+inspectCommand, 1)
+
+	buf.Reset()
+	reencryptingOptionsParser.WriteHelp(&buf)
+	reencryptingUsage := buf.String()
+	reencryptingUsage = strings.Replace(reencryptingUsage, usageString, "", 1)
+	reencryptingUsage = strings.Replace(reencryptingUsage, applicationOptions, " "+reencryptCommand, 1)
+
+	buf.Reset()
+	keysOptionsParser.WriteHelp(&buf)
+	keysUsage := buf.String()
+	keysUsage = strings.Replace(keysUsage, usageString, "", 1)
+	keysUsage = strings.Replace(keysUsage, applicationOptions, " "+keysCommand+" [generate | show | fingerprint]", 1)
+
+	configUsage := "\n config [show | set NAME VALUE | profiles | validate]\n"
+	credentialsUsage := "\n credentials [set NAME | delete NAME | list]\n"
+
+	buf.Reset()
+	loginOptionsParser.WriteHelp(&buf)
+	loginUsage := buf.String()
+	loginUsage = strings.Replace(loginUsage, usageString, "", 1)
+	loginUsage = strings.Replace(loginUsage, applicationOptions, " "+loginCommand, 1)
+
+	buf.Reset()
+	configurationOptionsParser.WriteHelp(&buf)
+	configurationUsage := buf.String()
+	configurationUsage = strings.Replace(configurationUsage, usageString, "", 1)
+	configurationUsage = strings.Replace(configurationUsage, applicationOptions, " global options", 1)
+
+	return header + inboxUsage + outboxUsage + resumablesUsage + uploadingUsage + downloadingUsage + verifyingUsage +
+		inspectingUsage + reencryptingUsage + keysUsage + configUsage + credentialsUsage +
+		loginUsage + configurationUsage
 }
@@ -0,0 +1,152 @@
+package requests
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxErrorBodySize is how much of the body of the unsuccessful response is read to explain the error.
+const maxErrorBodySize = 64 * 1024
+
+// Kinds of the unsuccessful responses, to be checked with errors.Is.
+var (
+	ErrUnauthorized = responseErrorKind{"unauthorized"}
+	ErrForbidden    = responseErrorKind{"forbidden"}
+	ErrNotFound     = responseErrorKind{"not found"}
+	ErrConflict     = responseErrorKind{"conflict"}
+	ErrServerError  = responseErrorKind{"server error"}
+)
+
+type responseErrorKind struct {
+	name string
+}
+
+func (k responseErrorKind) Error() string {
+	return k.name
+}
+
+// ResponseError structure represents the unsuccessful response of the server, with the details the server gave in
+// its body: the error code and the message, as well as the ID of the request, if the server tells it.
+type ResponseError struct {
+	StatusCode int
+	Status     string
+	Code       string
+	Message    string
+	RequestID  string
+}
+
+// errorBody structure lists the fields the proxy, the TSD File API and the OAuth2 servers explain the errors with.
+type errorBody struct {
+	Message          string `json:"message"`
+	Detail           string `json:"detail"`
+	StatusText       string `json:"statusText"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+	Code             string `json:"code"`
+	ErrorCode        string `json:"errorCode"`
+	RequestID        string `json:"requestId"`
+	TraceID          string `json:"traceId"`
+}
+
+// NewResponseError reads and closes the body of the unsuccessful response, decoding the details of the error from it.
+func NewResponseError(response *http.Response) *ResponseError {
+	responseError := ResponseError{StatusCode: response.StatusCode, Status: response.Status}
+	if responseError.Status == "" {
+		responseError.Status = strings.TrimSpace(strconv.Itoa(response.StatusCode) + " " + http.StatusText(response.StatusCode))
+	}
+	for _, header := range []string{"X-Request-Id", "X-Correlation-Id", "X-Amzn-Trace-Id"} {
+		if requestID := response.Header.Get(header); requestID != "" {
+			responseError.RequestID = requestID
+			break
+		}
+	}
+	if response.Body == nil {
+		return &responseError
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, maxErrorBodySize))
+	if err != nil {
+		return &responseError
+	}
+	var decoded errorBody
+	if json.Unmarshal(body, &decoded) != nil {
+		responseError.Message = strings.TrimSpace(string(body))
+		return &responseError
+	}
+	responseError.Message = firstNonEmpty(decoded.Message, decoded.Detail, decoded.ErrorDescription, decoded.StatusText)
+	responseError.Code = firstNonEmpty(decoded.Code, decoded.ErrorCode)
+	// OAuth2 servers tell the error code in "error", while Spring tells the status text there.
+	if responseError.Code == "" && decoded.Error != http.StatusText(response.StatusCode) {
+		responseError.Code = decoded.Error
+	}
+	if responseError.Message == "" && responseError.Code == "" {
+		responseError.Message = decoded.Error
+	}
+	if responseError.RequestID == "" {
+		responseError.RequestID = firstNonEmpty(decoded.RequestID, decoded.TraceID)
+	}
+	return &responseError
+}
+
+// CheckResponse returns ResponseError if the status of the response is not one of the expected ones, 200 by default.
+func CheckResponse(response *http.Response, expectedStatusCodes ...int) error {
+	if len(expectedStatusCodes) == 0 {
+		expectedStatusCodes = []int{http.StatusOK}
+	}
+	for _, statusCode := range expectedStatusCodes {
+		if response.StatusCode == statusCode {
+			return nil
+		}
+	}
+	return NewResponseError(response)
+}
+
+// Error returns the status along with the message, the code and the request ID given by the server.
+func (e *ResponseError) Error() string {
+	message := e.Status
+	if e.Message != "" {
+		message += ": " + e.Message
+	}
+	if e.Code != "" {
+		message += " [" + e.Code + "]"
+	}
+	if e.RequestID != "" {
+		message += " (request ID " + e.RequestID + ")"
+	}
+	return message
+}
+
+// Retryable method tells whether the request may succeed if it is made again later.
+func (e *ResponseError) Retryable() bool {
+	return transient(e.StatusCode)
+}
+
+// Is method makes the error match its kind: ErrUnauthorized, ErrForbidden, ErrNotFound, ErrConflict or ErrServerError.
+func (e *ResponseError) Is(target error) bool {
+	switch target {
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrForbidden:
+		return e.StatusCode == http.StatusForbidden
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrConflict:
+		return e.StatusCode == http.StatusConflict
+	case ErrServerError:
+		return e.StatusCode >= 500
+	}
+	return false
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
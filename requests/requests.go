@@ -2,22 +2,33 @@
 package requests
 
 import (
+	"bytes"
+	"context"
 	"io"
 	"net/http"
+	"time"
 )
 
 // Client is an interface providing DoRequest method for performing HTTP requests towards LocalEGA instance.
 type Client interface {
-	DoRequest(method string, url string, body io.Reader, headers map[string]string, params map[string]string, username string, password string) (*http.Response, error)
+	DoRequest(ctx context.Context, method string, url string, body io.Reader, headers map[string]string, params map[string]string, username string, password string) (*http.Response, error)
 }
 
 type defaultClient struct {
 	client http.Client
+	policy RetryPolicy
+	sleep  func(ctx context.Context, duration time.Duration) error
 }
 
-// NewClient constructs Client instance, possibly accepting custom http.Client implementation.
+// NewClient constructs Client instance, possibly accepting custom http.Client implementation. Failed requests are
+// repeated according to the policy of the default number of attempts.
 func NewClient(client *http.Client) Client {
-	defaultClient := defaultClient{}
+	return NewRetryingClient(client, NewRetryPolicy(defaultAttempts))
+}
+
+// NewRetryingClient constructs Client instance repeating failed requests according to the policy.
+func NewRetryingClient(client *http.Client, policy RetryPolicy) Client {
+	defaultClient := defaultClient{policy: policy, sleep: Sleep}
 	if client != nil {
 		defaultClient.client = *client
 	} else {
@@ -26,9 +37,39 @@ func NewClient(client *http.Client) Client {
 	return defaultClient
 }
 
-// DoRequest method can perform different HTTP requests with different parameters towards LocalEGA instance.
-func (c defaultClient) DoRequest(method, url string, body io.Reader, headers, params map[string]string, username, password string) (*http.Response, error) {
-	request, err := http.NewRequest(method, url, body)
+// DoRequest method can perform different HTTP requests with different parameters towards LocalEGA instance. The
+// request is repeated, with a backoff, on network errors and on 429, 502, 503 and 504 responses if it is idempotent:
+// by its method, when it has no body, or by its body constructed with NewReplayableBody. Once the context is done, the
+// request is aborted and not repeated anymore.
+func (c defaultClient) DoRequest(ctx context.Context, method, url string, body io.Reader, headers, params map[string]string, username, password string) (*http.Response, error) {
+	attempts := c.policy.Attempts
+	if attempts < 1 || !retryable(method, body) {
+		attempts = 1
+	}
+	for attempt := 1; ; attempt++ {
+		request, err := newRequest(ctx, method, url, body, headers, params, username, password)
+		if err != nil {
+			return nil, err
+		}
+		response, err := c.client.Do(request)
+		if attempt == attempts || err == nil && !transient(response.StatusCode) || ctx.Err() != nil {
+			return response, err
+		}
+		delay := c.policy.backoff(attempt, response)
+		if response != nil {
+			discard(response)
+		}
+		if err = c.sleep(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func newRequest(ctx context.Context, method, url string, body io.Reader, headers, params map[string]string, username, password string) (*http.Request, error) {
+	if replayable, ok := body.(*replayableBody); ok {
+		body = bytes.NewReader(replayable.data)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
 		return nil, err
 	}
@@ -47,5 +88,5 @@ func (c defaultClient) DoRequest(method, url string, body io.Reader, headers, pa
 		request.SetBasicAuth(username, password)
 	}
 
-	return c.client.Do(request)
+	return request, nil
 }
@@ -1,14 +1,18 @@
 package requests
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	aurora "github.com/logrusorgru/aurora/v3"
 )
@@ -48,7 +52,7 @@ func setup() {
 func TestDoRequest(t *testing.T) {
 	username := "username"
 	password := "password"
-	get, err := client.DoRequest(http.MethodGet,
+	get, err := client.DoRequest(context.Background(), http.MethodGet,
 		url,
 		strings.NewReader("Body"),
 		map[string]string{"header": "test header value"},
@@ -73,3 +77,196 @@ func TestDoRequest(t *testing.T) {
 func teardown() {
 	server.Close()
 }
+
+// flakyServer fails the first requests with the status, recording the bodies of all the requests.
+func flakyServer(t *testing.T, failures int, status int, retryAfter string) (*httptest.Server, *[]string) {
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body)+" "+strconv.FormatInt(r.ContentLength, 10))
+		if len(bodies) <= failures {
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			w.WriteHeader(status)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	t.Cleanup(server.Close)
+	return server, &bodies
+}
+
+// testPolicy is the retry policy of the test clients.
+var testPolicy = NewRetryPolicy(4)
+
+func newTestClient(server *httptest.Server, delays *[]time.Duration) Client {
+	testClient := NewRetryingClient(server.Client(), testPolicy).(defaultClient)
+	testClient.sleep = func(_ context.Context, delay time.Duration) error {
+		*delays = append(*delays, delay)
+		return nil
+	}
+	return testClient
+}
+
+func TestDoRequestRetriesReplayableBody(t *testing.T) {
+	server, bodies := flakyServer(t, 2, http.StatusBadGateway, "")
+	var delays []time.Duration
+	response, err := newTestClient(server, &delays).DoRequest(context.Background(), http.MethodPatch, server.URL, NewReplayableBody([]byte("chunk")), nil, nil, "", "")
+	if err != nil || response.StatusCode != http.StatusOK {
+		t.Fatal(response, err)
+	}
+	if len(*bodies) != 3 || (*bodies)[0] != "chunk 5" || (*bodies)[2] != "chunk 5" {
+		t.Error(*bodies)
+	}
+	if len(delays) != 2 || delays[0] > testPolicy.InitialBackoff || delays[1] < testPolicy.InitialBackoff ||
+		delays[1] > 2*testPolicy.InitialBackoff {
+		t.Error(delays)
+	}
+}
+
+func TestDoRequestRetryAfter(t *testing.T) {
+	server, bodies := flakyServer(t, 1, http.StatusTooManyRequests, "7")
+	var delays []time.Duration
+	response, err := newTestClient(server, &delays).DoRequest(context.Background(), http.MethodGet, server.URL, nil, nil, nil, "", "")
+	if err != nil || response.StatusCode != http.StatusOK || len(*bodies) != 2 {
+		t.Fatal(response, err)
+	}
+	if len(delays) != 1 || delays[0] != 7*time.Second {
+		t.Error(delays)
+	}
+}
+
+func TestDoRequestGivesUp(t *testing.T) {
+	server, bodies := flakyServer(t, 10, http.StatusServiceUnavailable, "")
+	var delays []time.Duration
+	response, err := newTestClient(server, &delays).DoRequest(context.Background(), http.MethodGet, server.URL, nil, nil, nil, "", "")
+	if err != nil || response.StatusCode != http.StatusServiceUnavailable || len(*bodies) != testPolicy.Attempts {
+		t.Error(response, err, *bodies)
+	}
+}
+
+func TestDoRequestNotIdempotent(t *testing.T) {
+	server, bodies := flakyServer(t, 1, http.StatusBadGateway, "")
+	var delays []time.Duration
+	client := newTestClient(server, &delays)
+	response, err := client.DoRequest(context.Background(), http.MethodPatch, server.URL, strings.NewReader("chunk"), nil, nil, "", "")
+	if err != nil || response.StatusCode != http.StatusBadGateway || len(*bodies) != 1 {
+		t.Error(response, err, *bodies)
+	}
+	response, err = client.DoRequest(context.Background(), http.MethodPost, server.URL, nil, nil, nil, "", "")
+	if err != nil || response.StatusCode != http.StatusOK || len(*bodies) != 2 {
+		t.Error(response, err, *bodies)
+	}
+	server, bodies = flakyServer(t, 1, http.StatusInternalServerError, "")
+	response, err = newTestClient(server, &delays).DoRequest(context.Background(), http.MethodGet, server.URL, nil, nil, nil, "", "")
+	if err != nil || response.StatusCode != http.StatusInternalServerError || len(*bodies) != 1 {
+		t.Error(response, err, *bodies)
+	}
+}
+
+func TestDoRequestCancelled(t *testing.T) {
+	server, bodies := flakyServer(t, 10, http.StatusServiceUnavailable, "")
+	ctx, cancel := context.WithCancel(context.Background())
+	testClient := NewRetryingClient(server.Client(), testPolicy).(defaultClient)
+	testClient.sleep = func(ctx context.Context, _ time.Duration) error {
+		cancel()
+		return Sleep(ctx, time.Hour)
+	}
+	_, err := testClient.DoRequest(ctx, http.MethodGet, server.URL, nil, nil, nil, "", "")
+	if !errors.Is(err, context.Canceled) || len(*bodies) != 1 {
+		t.Error(err, *bodies)
+	}
+	_, err = testClient.DoRequest(ctx, http.MethodGet, server.URL, nil, nil, nil, "", "")
+	if !errors.Is(err, context.Canceled) || len(*bodies) != 1 {
+		t.Error(err, *bodies)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 4 * time.Second, MaxRetryAfter: time.Minute}
+	for attempt, limit := range []time.Duration{0, time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		if attempt == 0 {
+			continue
+		}
+		if delay := policy.backoff(attempt, nil); delay < limit/2 || delay > limit {
+			t.Error(attempt, delay)
+		}
+	}
+	response := &http.Response{Header: http.Header{"Retry-After": {"3600"}}}
+	if delay := policy.backoff(1, response); delay != time.Minute {
+		t.Error(delay)
+	}
+	response.Header.Set("Retry-After", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat))
+	if delay := policy.backoff(1, response); delay != 0 {
+		t.Error(delay)
+	}
+}
+
+func TestNewResponseErrorSpring(t *testing.T) {
+	response := http.Response{
+		StatusCode: http.StatusForbidden,
+		Status:     "403 Forbidden",
+		Header:     http.Header{"X-Request-Id": []string{"abc"}},
+		Body:       ioutil.NopCloser(strings.NewReader(`{"status": 403, "error": "Forbidden", "message": "access denied"}`)),
+	}
+	err := CheckResponse(&response)
+	responseError, ok := err.(*ResponseError)
+	if !ok {
+		t.Fatal(err)
+	}
+	if responseError.Message != "access denied" || responseError.Code != "" || responseError.RequestID != "abc" {
+		t.Error(responseError)
+	}
+	if err.Error() != "403 Forbidden: access denied (request ID abc)" {
+		t.Error(err.Error())
+	}
+	if !errors.Is(err, ErrForbidden) || errors.Is(err, ErrUnauthorized) || responseError.Retryable() {
+		t.Error(err)
+	}
+}
+
+func TestNewResponseErrorOAuth(t *testing.T) {
+	response := http.Response{
+		StatusCode: http.StatusBadRequest,
+		Body:       ioutil.NopCloser(strings.NewReader(`{"error": "invalid_grant", "error_description": "token expired"}`)),
+	}
+	err := NewResponseError(&response)
+	if err.Code != "invalid_grant" || err.Message != "token expired" {
+		t.Error(err)
+	}
+	if err.Error() != "400 Bad Request: token expired [invalid_grant]" {
+		t.Error(err.Error())
+	}
+}
+
+func TestNewResponseErrorPlainText(t *testing.T) {
+	response := http.Response{
+		StatusCode: http.StatusServiceUnavailable,
+		Status:     "503 Service Unavailable",
+		Body:       ioutil.NopCloser(strings.NewReader("maintenance\n")),
+	}
+	err := NewResponseError(&response)
+	if err.Message != "maintenance" || !err.Retryable() || !errors.Is(err, ErrServerError) {
+		t.Error(err)
+	}
+}
+
+func TestNewResponseErrorNoBody(t *testing.T) {
+	err := NewResponseError(&http.Response{StatusCode: http.StatusNotFound})
+	if err.Error() != "404 Not Found" || !errors.Is(err, ErrNotFound) {
+		t.Error(err)
+	}
+}
+
+func TestCheckResponseExpected(t *testing.T) {
+	if err := CheckResponse(&http.Response{StatusCode: http.StatusOK}); err != nil {
+		t.Error(err)
+	}
+	if err := CheckResponse(&http.Response{StatusCode: http.StatusCreated}, http.StatusOK, http.StatusCreated); err != nil {
+		t.Error(err)
+	}
+	if err := CheckResponse(&http.Response{StatusCode: http.StatusConflict}, http.StatusCreated); !errors.Is(err, ErrConflict) {
+		t.Error(err)
+	}
+}
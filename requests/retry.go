@@ -0,0 +1,132 @@
+package requests
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy structure holds the settings of repeating failed requests: the number of attempts, the backoff before
+// the second attempt, doubled before every next one and randomized, and the limits of the backoff and of the delay
+// the server may ask for with Retry-After header.
+type RetryPolicy struct {
+	Attempts       int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	MaxRetryAfter  time.Duration
+}
+
+// defaultAttempts is the number of attempts the clients constructed with NewClient make.
+const defaultAttempts = 4
+
+// NewRetryPolicy constructs RetryPolicy making the number of attempts, with the default backoff and limits.
+func NewRetryPolicy(attempts int) RetryPolicy {
+	return RetryPolicy{
+		Attempts:       attempts,
+		InitialBackoff: 500 * time.Millisecond,
+		MaxBackoff:     30 * time.Second,
+		MaxRetryAfter:  5 * time.Minute,
+	}
+}
+
+// replayableBody is the request body that can be sent again, marking the request as safe to repeat.
+type replayableBody struct {
+	io.Reader
+	data []byte
+}
+
+// NewReplayableBody wraps the data into the request body that is sent again if the request is repeated. Passing it
+// to DoRequest tells that the request is idempotent, so that it is repeated on failure whatever its method is.
+func NewReplayableBody(data []byte) io.Reader {
+	return &replayableBody{bytes.NewReader(data), data}
+}
+
+// retryable tells whether the request may be repeated: it is idempotent by its method or by its replayable body, and
+// its body, if any, can be sent again.
+func retryable(method string, body io.Reader) bool {
+	if _, ok := body.(*replayableBody); ok {
+		return true
+	}
+	if body != nil {
+		return false
+	}
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// transient tells whether the response status is worth another attempt.
+func transient(statusCode int) bool {
+	switch statusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// backoff returns the delay before the attempt following the given one: the one the server asked for with
+// Retry-After header, or the exponential backoff with jitter.
+func (p RetryPolicy) backoff(attempt int, response *http.Response) time.Duration {
+	if response != nil {
+		if delay, ok := retryAfter(response.Header.Get("Retry-After")); ok {
+			if delay > p.MaxRetryAfter {
+				delay = p.MaxRetryAfter
+			}
+			return delay
+		}
+	}
+	delay := p.InitialBackoff
+	for i := 1; i < attempt && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// retryAfter parses Retry-After header, given either in seconds or as HTTP date.
+func retryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		delay := time.Until(date)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+	return 0, false
+}
+
+// Sleep waits for the duration, returning early with the error of the context if it gets done first.
+func Sleep(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// discard reads the rest of the body of the response that is not going to be used, so that the connection is reused.
+func discard(response *http.Response) {
+	_, _ = io.Copy(ioutil.Discard, response.Body)
+	_ = response.Body.Close()
+}
@@ -0,0 +1,133 @@
+package resuming
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// JournalEntry structure records the progress of the upload of a local file: the file as it was when the upload
+// started, the upload ID, the last chunk acknowledged by the server along with all the previous ones, the offset
+// following it and the states of the SHA-256 and MD5 hash functions fed with the bytes before the offset.
+type JournalEntry struct {
+	Path        string    `json:"path"`
+	FileName    string    `json:"fileName"`
+	Size        int64     `json:"size"`
+	ModTime     time.Time `json:"modTime"`
+	UploadID    string    `json:"uploadId"`
+	Chunk       int64     `json:"chunk"`
+	Offset      int64     `json:"offset"`
+	SHA256State []byte    `json:"sha256State,omitempty"`
+	MD5State    []byte    `json:"md5State,omitempty"`
+}
+
+// Changed method tells whether the local file differs in size or modification time from the one being uploaded when
+// the entry was recorded.
+func (e JournalEntry) Changed(stat os.FileInfo) bool {
+	return stat.Size() != e.Size || !stat.ModTime().Equal(e.ModTime)
+}
+
+// Journal structure represents the directory the progress of the interrupted uploads is recorded in, one file per
+// upload, named after the name of the file in the inbox.
+type Journal struct {
+	directory string
+}
+
+// NewJournal constructs Journal kept in the directory.
+func NewJournal(directory string) *Journal {
+	return &Journal{directory: directory}
+}
+
+// Load method returns the entry of the upload of the file with the name in the inbox, nil if there is none.
+func (j *Journal) Load(fileName string) (*JournalEntry, error) {
+	return j.read(j.path(fileName))
+}
+
+// Store method records the entry, replacing the previous one of the same file. The entry is written to a temporary
+// file first, so that an interruption never leaves it half-written.
+func (j *Journal) Store(entry JournalEntry) error {
+	content, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(j.directory, 0700); err != nil {
+		return err
+	}
+	path := j.path(entry.FileName)
+	if err = os.WriteFile(path+".tmp", content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Delete method removes the entry of the upload of the file with the name in the inbox, if any.
+func (j *Journal) Delete(fileName string) error {
+	err := os.Remove(j.path(fileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// DeleteUpload method removes the entries of the upload with the ID, if any.
+func (j *Journal) DeleteUpload(uploadID string) error {
+	entries, err := j.List()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.UploadID != uploadID {
+			continue
+		}
+		if err = j.Delete(entry.FileName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// List method returns all the recorded entries.
+func (j *Journal) List() ([]JournalEntry, error) {
+	paths, err := filepath.Glob(filepath.Join(j.directory, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]JournalEntry, 0, len(paths))
+	for _, path := range paths {
+		entry, err := j.read(path)
+		if err != nil {
+			return nil, err
+		}
+		if entry != nil {
+			entries = append(entries, *entry)
+		}
+	}
+	return entries, nil
+}
+
+// read reads the entry from the file; a missing file means there is no entry.
+func (j *Journal) read(path string) (*JournalEntry, error) {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entry JournalEntry
+	if err = json.Unmarshal(content, &entry); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return &entry, nil
+}
+
+// path returns the path of the file of the entry, named after the hash of the name of the file in the inbox, as the
+// latter may contain slashes.
+func (j *Journal) path(fileName string) string {
+	sum := sha256.Sum256([]byte(fileName))
+	return filepath.Join(j.directory, hex.EncodeToString(sum[:16])+".json")
+}
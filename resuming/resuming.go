@@ -2,7 +2,7 @@
 package resuming
 
 import (
-	"errors"
+	"context"
 	"io/ioutil"
 	"net/http"
 
@@ -21,8 +21,8 @@ type Resumable struct {
 
 // ResumablesManager interface provides method for managing resumable uploads.
 type ResumablesManager interface {
-	ListResumables() (*[]Resumable, error)
-	DeleteResumable(uploadID string) error
+	ListResumables(ctx context.Context) (*[]Resumable, error)
+	DeleteResumable(ctx context.Context, uploadID string) error
 }
 
 type defaultResumablesManager struct {
@@ -41,9 +41,9 @@ func NewResumablesManager(client *requests.Client) (ResumablesManager, error) {
 }
 
 // ListResumables method lists resumable uploads.
-func (rm defaultResumablesManager) ListResumables() (*[]Resumable, error) {
+func (rm defaultResumablesManager) ListResumables(ctx context.Context) (*[]Resumable, error) {
 	configuration := conf.NewConfiguration()
-	response, err := rm.client.DoRequest(http.MethodGet,
+	response, err := rm.client.DoRequest(ctx, http.MethodGet,
 		configuration.GetLocalEGAInstanceURL()+"/resumables",
 		nil,
 		map[string]string{"Proxy-Authorization": "Bearer " + configuration.GetElixirAAIToken()},
@@ -53,8 +53,8 @@ func (rm defaultResumablesManager) ListResumables() (*[]Resumable, error) {
 	if err != nil {
 		return nil, err
 	}
-	if response.StatusCode != 200 {
-		return nil, errors.New(response.Status)
+	if err = requests.CheckResponse(response); err != nil {
+		return nil, err
 	}
 	body, err := ioutil.ReadAll(response.Body)
 	if err != nil {
@@ -82,10 +82,11 @@ func (rm defaultResumablesManager) ListResumables() (*[]Resumable, error) {
 	return &resumables, nil
 }
 
-// DeleteResumable method deletes resumable upload by its ID.
-func (rm defaultResumablesManager) DeleteResumable(uploadID string) error {
+// DeleteResumable method deletes resumable upload by its ID, along with its entry in the local journal, so that the
+// file is not resumed from the deleted upload later.
+func (rm defaultResumablesManager) DeleteResumable(ctx context.Context, uploadID string) error {
 	configuration := conf.NewConfiguration()
-	response, err := rm.client.DoRequest(http.MethodDelete,
+	response, err := rm.client.DoRequest(ctx, http.MethodDelete,
 		configuration.GetLocalEGAInstanceURL()+"/resumables",
 		nil,
 		map[string]string{"Proxy-Authorization": "Bearer " + configuration.GetElixirAAIToken()},
@@ -95,8 +96,8 @@ func (rm defaultResumablesManager) DeleteResumable(uploadID string) error {
 	if err != nil {
 		return err
 	}
-	if response.StatusCode != 200 {
-		return errors.New(response.Status)
+	if err = requests.CheckResponse(response); err != nil {
+		return err
 	}
-	return nil
+	return NewJournal(configuration.GetResumeJournalDirectory()).DeleteUpload(uploadID)
 }
@@ -1,19 +1,23 @@
 package resuming
 
 import (
+	"context"
+	"github.com/elixir-oslo/lega-commander/conf"
 	"github.com/elixir-oslo/lega-commander/requests"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 type mockClient struct {
 }
 
-func (mockClient) DoRequest(method, url string, _ io.Reader, _, params map[string]string, _, _ string) (*http.Response, error) {
+func (mockClient) DoRequest(_ context.Context, method, url string, _ io.Reader, _, params map[string]string, _, _ string) (*http.Response, error) {
 	if strings.HasSuffix(url, "/resumables") {
 		if method == http.MethodGet {
 			body := ioutil.NopCloser(strings.NewReader(`{"resumables": [{"id": "1", "fileName": "test.enc", "nextOffset": 100, "maxChunk": 10}]}`))
@@ -41,7 +45,7 @@ func TestListResumables(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	resumables, err := resumablesManager.ListResumables()
+	resumables, err := resumablesManager.ListResumables(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -59,15 +63,26 @@ func TestDeleteResumable200(t *testing.T) {
 	_ = os.Setenv("CENTRAL_EGA_PASSWORD", "pass")
 	_ = os.Setenv("LOCAL_EGA_INSTANCE_URL", "http://localhost/")
 	_ = os.Setenv("ELIXIR_AAI_TOKEN", "token")
+	t.Setenv("LEGA_COMMANDER_RESUME_JOURNAL", t.TempDir())
+	journal := NewJournal(conf.NewConfiguration().GetResumeJournalDirectory())
+	for _, entry := range []JournalEntry{{FileName: "deleted.enc", UploadID: "123"}, {FileName: "kept.enc", UploadID: "1"}} {
+		if err := journal.Store(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
 	var client requests.Client = mockClient{}
 	resumablesManager, err := NewResumablesManager(&client)
 	if err != nil {
 		t.Error(err)
 	}
-	err = resumablesManager.DeleteResumable("123")
+	err = resumablesManager.DeleteResumable(context.Background(), "123")
 	if err != nil {
 		t.Error(err)
 	}
+	entries, err := journal.List()
+	if err != nil || len(entries) != 1 || entries[0].UploadID != "1" {
+		t.Error("journal entry of the deleted upload is left behind", entries, err)
+	}
 }
 
 func TestDeleteResumable500(t *testing.T) {
@@ -80,8 +95,66 @@ func TestDeleteResumable500(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	err = resumablesManager.DeleteResumable("12")
+	err = resumablesManager.DeleteResumable(context.Background(), "12")
 	if err == nil {
 		t.Error(err)
 	}
 }
+
+func TestJournal(t *testing.T) {
+	journal := NewJournal(filepath.Join(t.TempDir(), "default"))
+	entry, err := journal.Load("batch/test.enc")
+	if err != nil || entry != nil {
+		t.Error(entry, err)
+	}
+	modTime := time.Now()
+	stored := JournalEntry{Path: "/data/test.enc", FileName: "batch/test.enc", Size: 100, ModTime: modTime, UploadID: "1",
+		Chunk: 2, Offset: 50, SHA256State: []byte{1, 2}, MD5State: []byte{3}}
+	if err = journal.Store(stored); err != nil {
+		t.Fatal(err)
+	}
+	stored.Chunk, stored.Offset = 3, 75
+	if err = journal.Store(stored); err != nil {
+		t.Fatal(err)
+	}
+	entry, err = journal.Load("batch/test.enc")
+	if err != nil || entry == nil {
+		t.Fatal(entry, err)
+	}
+	if entry.UploadID != "1" || entry.Chunk != 3 || entry.Offset != 75 || !entry.ModTime.Equal(modTime) ||
+		string(entry.SHA256State) != string([]byte{1, 2}) {
+		t.Error(entry)
+	}
+	entries, err := journal.List()
+	if err != nil || len(entries) != 1 {
+		t.Error(entries, err)
+	}
+	if err = journal.Delete("batch/test.enc"); err != nil {
+		t.Error(err)
+	}
+	if err = journal.Delete("batch/test.enc"); err != nil {
+		t.Error(err)
+	}
+	if entries, err = journal.List(); err != nil || len(entries) != 0 {
+		t.Error(entries, err)
+	}
+}
+
+func TestJournalEntryChanged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.enc")
+	if err := os.WriteFile(path, []byte("test"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := JournalEntry{Size: stat.Size(), ModTime: stat.ModTime()}
+	if entry.Changed(stat) {
+		t.Error("unchanged file is reported as changed")
+	}
+	entry.Size++
+	if !entry.Changed(stat) {
+		t.Error("changed file is not reported as changed")
+	}
+}
@@ -0,0 +1,230 @@
+package streaming
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"strconv"
+
+	"github.com/cheggaaa/pb/v3"
+	"github.com/elixir-oslo/lega-commander/conf"
+)
+
+// chunk structure represents a single part of the file being uploaded, its MD5 checksum, along with the progress of
+// the upload once the chunk is acknowledged.
+type chunk struct {
+	number int64
+	data   []byte
+	md5    string
+	next   checkpoint
+}
+
+// checkpoint structure represents the progress of the upload: the number of the next chunk to send, the offset it
+// starts at and the states of the hash functions fed with the bytes before the offset.
+type checkpoint struct {
+	chunk       int64
+	offset      int64
+	sha256State []byte
+	md5State    []byte
+}
+
+// chunkSender sends a single chunk and returns the upload ID reported back by the server.
+// The uploadID argument is empty for the very first chunk of a new upload.
+type chunkSender func(ctx context.Context, c chunk, uploadID string) (string, error)
+
+// progressRecorder records the progress of the upload, once all the chunks before the checkpoint are acknowledged.
+type progressRecorder func(uploadID string, c checkpoint) error
+
+// InterruptedUploadError is returned when the upload stops before the whole file is sent because its context is done.
+// It tells the upload ID, the offset and the number of the chunk the upload can be resumed from.
+type InterruptedUploadError struct {
+	Path     string
+	UploadID string
+	Offset   int64
+	Chunk    int64
+}
+
+// Error returns the message telling where the upload has stopped.
+func (e *InterruptedUploadError) Error() string {
+	return "Upload of " + e.Path + " is interrupted at " + strconv.FormatInt(e.Offset, 10) + " bytes, chunk " +
+		strconv.FormatInt(e.Chunk, 10) + " (upload ID " + e.UploadID + "), use --resume to continue."
+}
+
+// Unwrap makes the error match context.Canceled.
+func (e *InterruptedUploadError) Unwrap() error {
+	return context.Canceled
+}
+
+// interruptedAt completes InterruptedUploadError returned by sendChunks with the path of the file. Other errors are
+// returned as they are.
+func interruptedAt(err error, path string) error {
+	if interrupted, ok := err.(*InterruptedUploadError); ok {
+		interrupted.Path = path
+	}
+	return err
+}
+
+// fileHashes structure holds the SHA-256 and MD5 hash functions the uploaded bytes are fed to.
+type fileHashes struct {
+	sha256 hash.Hash
+	md5    hash.Hash
+}
+
+func newFileHashes() *fileHashes {
+	return &fileHashes{sha256: sha256.New(), md5: md5.New()}
+}
+
+func (h *fileHashes) Write(p []byte) (int, error) {
+	h.sha256.Write(p)
+	return h.md5.Write(p)
+}
+
+// states returns the marshalled states of the hash functions.
+func (h *fileHashes) states() ([]byte, []byte) {
+	sha256State, _ := h.sha256.(encoding.BinaryMarshaler).MarshalBinary()
+	md5State, _ := h.md5.(encoding.BinaryMarshaler).MarshalBinary()
+	return sha256State, md5State
+}
+
+// restore sets the states of the hash functions to the ones recorded at the checkpoint.
+func (h *fileHashes) restore(c checkpoint) error {
+	if err := h.sha256.(encoding.BinaryUnmarshaler).UnmarshalBinary(c.sha256State); err != nil {
+		return err
+	}
+	return h.md5.(encoding.BinaryUnmarshaler).UnmarshalBinary(c.md5State)
+}
+
+// sendChunks reads the file from the reader and sends it chunk by chunk, starting from the checkpoint. The server
+// appends every chunk to the ones received before, so the chunks are sent one at a time, in file order; meanwhile up
+// to LEGA_COMMANDER_READ_AHEAD_CHUNKS chunks are read ahead, fed to the hash functions in file order and get their MD5
+// checksums calculated concurrently. The upload ID the server assigns in response to the first chunk of a new upload
+// is used for the following ones. The progress is passed to record, if set, every time a chunk is acknowledged.
+//
+// Once the context is done, no more chunks are read and the ones already read are sent, so that the upload can be
+// resumed; InterruptedUploadError is returned then. The chunks themselves are sent with the context that is never
+// done, in order not to leave any of them half-written.
+func sendChunks(ctx context.Context, reader io.Reader, uploadID *string, start checkpoint, hashes *fileHashes, bar *pb.ProgressBar, send chunkSender, record progressRecorder) (*string, error) {
+	configuration := conf.NewConfiguration()
+	chunkSize := configuration.GetChunkSize() * 1024 * 1024
+	readAhead := configuration.GetReadAheadChunks()
+	number, offset := start.chunk, start.offset
+	sendCtx := context.WithoutCancel(ctx)
+	// nextChunk reads the chunk following the previous one, feeding it to the hash functions.
+	nextChunk := func(buffer []byte) (chunk, error) {
+		read, err := readChunk(reader, buffer)
+		if err != nil {
+			return chunk{}, err
+		}
+		hashes.Write(buffer[:read])
+		offset += int64(read)
+		sha256State, md5State := hashes.states()
+		c := chunk{number: number, data: buffer[:read], next: checkpoint{number + 1, offset, sha256State, md5State}}
+		number++
+		return c, nil
+	}
+	// sendInOrder sends the chunk once all the previous ones are acknowledged, and records the progress.
+	progress := start
+	sendInOrder := func(c chunk) error {
+		id := ""
+		if uploadID != nil {
+			id = *uploadID
+		}
+		assignedID, err := send(sendCtx, c, id)
+		if err != nil {
+			return err
+		}
+		if uploadID == nil {
+			uploadID = &assignedID
+		}
+		bar.Add(len(c.data))
+		progress = c.next
+		if record == nil {
+			return nil
+		}
+		return record(*uploadID, progress)
+	}
+
+	// aheadChunk is the chunk read ahead, along with the channel its MD5 checksum is delivered to.
+	type aheadChunk struct {
+		chunk
+		checksum chan string
+	}
+	buffers := make(chan []byte, readAhead)
+	for i := 0; i < readAhead; i++ {
+		buffers <- make([]byte, chunkSize)
+	}
+	queue := make(chan aheadChunk, readAhead)
+	failed := make(chan struct{})
+	sent := make(chan struct{})
+	var sendErr error
+	go func() {
+		defer close(sent)
+		for c := range queue {
+			c.md5 = <-c.checksum
+			if sendErr == nil {
+				if sendErr = sendInOrder(c.chunk); sendErr != nil {
+					close(failed)
+				}
+			}
+			buffers <- c.data[:cap(c.data)]
+		}
+	}()
+	var readErr error
+	interrupted, empty := false, uploadID == nil
+reading:
+	for {
+		var buffer []byte
+		select {
+		case buffer = <-buffers:
+		case <-failed:
+			break reading
+		}
+		if ctx.Err() != nil {
+			interrupted = true
+			break
+		}
+		c, err := nextChunk(buffer)
+		if err != nil {
+			if err != io.EOF {
+				readErr = err
+			}
+			break
+		}
+		empty = false
+		checksum := make(chan string, 1)
+		go func(data []byte) {
+			sum := md5.Sum(data)
+			checksum <- hex.EncodeToString(sum[:])
+		}(c.data)
+		queue <- aheadChunk{c, checksum}
+	}
+	close(queue)
+	<-sent
+	switch {
+	case sendErr != nil:
+		return uploadID, sendErr
+	case readErr != nil:
+		return uploadID, readErr
+	case interrupted && uploadID == nil:
+		return nil, ctx.Err()
+	case interrupted:
+		return uploadID, &InterruptedUploadError{UploadID: *uploadID, Offset: progress.offset, Chunk: progress.chunk}
+	case empty:
+		return nil, errors.New("nothing to upload, the file is empty")
+	}
+	return uploadID, nil
+}
+
+// readChunk fills the buffer from the reader, only returning a shorter chunk at the end of the file.
+func readChunk(reader io.Reader, buffer []byte) (int, error) {
+	read, err := io.ReadFull(reader, buffer)
+	if err == io.ErrUnexpectedEOF {
+		return read, nil
+	}
+	return read, err
+}
@@ -0,0 +1,231 @@
+package streaming
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+
+	"github.com/elixir-oslo/lega-commander/conf"
+	"github.com/elixir-oslo/lega-commander/requests"
+	"github.com/golang-jwt/jwt"
+)
+
+// tokenVerifier structure holds the settings the TSD token is verified with. The signature is checked against the
+// pinned key, if set, or against the key of the JWKS otherwise; without either of them it is not checked at all, which
+// NewStreamer warns about.
+type tokenVerifier struct {
+	client   requests.Client
+	jwksURL  string
+	keyPath  string
+	audience string
+}
+
+// jsonWebKey structure represents a public key of JSON Web Key Set, RFC 7517.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func newTokenVerifier(client requests.Client, c conf.Configuration) tokenVerifier {
+	return tokenVerifier{client: client, jwksURL: c.GetTSDTokenJWKSURL(), keyPath: c.GetTSDTokenKey(), audience: c.GetTSDTokenAudience()}
+}
+
+// verify checks the signature of the token and its exp, nbf and aud claims, and makes sure the token carries the user
+// claim the upload URL is made of.
+func (v tokenVerifier) verify(ctx context.Context, tokenString string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	var err error
+	if v.keyPath == "" && v.jwksURL == "" {
+		_, _, err = new(jwt.Parser).ParseUnverified(tokenString, claims)
+		if err == nil {
+			err = claims.Valid()
+		}
+	} else {
+		_, err = jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+			return v.key(ctx, token)
+		})
+	}
+	if err != nil {
+		return nil, errors.New("TSD token is not valid: " + err.Error())
+	}
+	if v.audience != "" && !claims.VerifyAudience(v.audience, true) {
+		return nil, errors.New("TSD token is not issued for " + v.audience)
+	}
+	if user, ok := claims["user"].(string); !ok || user == "" {
+		return nil, errors.New("TSD token does not carry the user claim")
+	}
+	return claims, nil
+}
+
+// key returns the public key to verify the signature of the token with, making sure it suits the signing method.
+func (v tokenVerifier) key(ctx context.Context, token *jwt.Token) (interface{}, error) {
+	var key crypto.PublicKey
+	var err error
+	if v.keyPath != "" {
+		key, err = readPublicKeyPEM(v.keyPath)
+	} else {
+		kid, _ := token.Header["kid"].(string)
+		key, err = v.jwksKey(ctx, kid)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case *rsa.PublicKey:
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); ok {
+			return key, nil
+		}
+		if _, ok := token.Method.(*jwt.SigningMethodRSAPSS); ok {
+			return key, nil
+		}
+	case *ecdsa.PublicKey:
+		if _, ok := token.Method.(*jwt.SigningMethodECDSA); ok {
+			return key, nil
+		}
+	case ed25519.PublicKey:
+		if _, ok := token.Method.(*jwt.SigningMethodEd25519); ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("signing method %v does not match the key", token.Method.Alg())
+}
+
+// jwksKey fetches the JSON Web Key Set and returns its signing key of the ID, or the only one if the ID is empty.
+func (v tokenVerifier) jwksKey(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	response, err := v.client.DoRequest(ctx, http.MethodGet, v.jwksURL, nil, nil, nil, "", "")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if err = requests.CheckResponse(response); err != nil {
+		return nil, fmt.Errorf("%v: %w", v.jwksURL, err)
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err = json.Unmarshal(body, &jwks); err != nil {
+		return nil, errors.New(v.jwksURL + ": " + err.Error())
+	}
+	var candidates []jsonWebKey
+	for _, key := range jwks.Keys {
+		if (key.Use == "" || key.Use == "sig") && (kid == "" || key.Kid == kid) {
+			candidates = append(candidates, key)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, errors.New("key " + kid + " is not found in " + v.jwksURL)
+	}
+	if len(candidates) > 1 {
+		return nil, errors.New("token does not tell which of the keys of " + v.jwksURL + " it is signed with")
+	}
+	return candidates[0].publicKey()
+}
+
+// publicKey converts the JSON Web Key to the public key.
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeKeyParameter(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeKeyParameter(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.New("curve " + k.Crv + " is not supported")
+		}
+		x, err := decodeKeyParameter(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeKeyParameter(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, errors.New("curve " + k.Crv + " is not supported")
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("Ed25519 key " + k.Kid + " is not valid")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, errors.New("key type " + k.Kty + " is not supported")
+}
+
+func decodeKeyParameter(value string) (*big.Int, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(decoded), nil
+}
+
+// readPublicKeyPEM reads RSA, EC or Ed25519 public key, or the certificate holding it, from the PEM file.
+func readPublicKeyPEM(path string) (crypto.PublicKey, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, errors.New(path + ": PEM data is not found")
+	}
+	switch block.Type {
+	case "CERTIFICATE":
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.New(path + ": " + err.Error())
+		}
+		return certificate.PublicKey, nil
+	case "RSA PUBLIC KEY":
+		key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, errors.New(path + ": " + err.Error())
+		}
+		return key, nil
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.New(path + ": " + err.Error())
+	}
+	return key, nil
+}
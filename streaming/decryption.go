@@ -0,0 +1,85 @@
+package streaming
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/cheggaaa/pb/v3"
+	"github.com/elixir-oslo/lega-commander/requests"
+	aurora "github.com/logrusorgru/aurora/v3"
+	"github.com/neicnordic/crypt4gh/model/headers"
+	crypt4gh "github.com/neicnordic/crypt4gh/streaming"
+)
+
+// downloadDecrypted downloads the file and decrypts it on the fly, writing the plaintext to the local file named
+// without the .c4gh suffix. The header is checked to be decryptable with the key before the local file is created, and
+// an incomplete local file is removed, so that the download can be rerun.
+func (s defaultStreamer) downloadDecrypted(ctx context.Context, fileName string, privateKey [32]byte) error {
+	plaintextFileName := decryptedFileName(fileName)
+	if fileExists(plaintextFileName) {
+		return errors.New("File " + plaintextFileName + " exists locally, aborting.")
+	}
+	fileSize, err := s.exportedFileSize(ctx, fileName)
+	if err != nil {
+		return err
+	}
+	response, err := s.requestExportedFile(ctx, fileName, 0)
+	if err != nil {
+		return err
+	}
+	if err = requests.CheckResponse(response); err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	bar := pb.New64(fileSize)
+	barReader := bar.NewProxyReader(response.Body)
+	header, err := headers.ReadHeader(barReader)
+	if err != nil {
+		return errors.New(fileName + ": " + err.Error())
+	}
+	if _, err = headers.NewHeader(bytes.NewReader(header), privateKey); err != nil {
+		return errors.New(fileName + ": header can not be decrypted with the given key: " + err.Error())
+	}
+	reader, err := crypt4gh.NewCrypt4GHReader(io.MultiReader(bytes.NewReader(header), barReader), privateKey, nil)
+	if err != nil {
+		return errors.New(fileName + ": " + err.Error())
+	}
+	file, err := os.OpenFile(plaintextFileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return errors.New("File " + plaintextFileName + " exists locally, aborting.")
+		}
+		return err
+	}
+	fmt.Println(aurora.Blue("Downloading and decrypting file: " + fileName + " (" + strconv.FormatInt(fileSize, 10) + " bytes) to " + plaintextFileName))
+	bar.Start()
+	_, err = io.Copy(file, reader)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	bar.Finish()
+	if err != nil {
+		_ = os.Remove(plaintextFileName)
+		return errors.New(fileName + ": " + err.Error())
+	}
+	if bar.Current() != fileSize {
+		_ = os.Remove(plaintextFileName)
+		return errors.New("File " + fileName + " is incomplete: " + strconv.FormatInt(bar.Current(), 10) + " of " +
+			strconv.FormatInt(fileSize, 10) + " bytes downloaded.")
+	}
+	return nil
+}
+
+// decryptedFileName strips the .c4gh suffix from the name of the file, or adds .dec suffix if there is none.
+func decryptedFileName(fileName string) string {
+	if strings.HasSuffix(fileName, ".c4gh") {
+		return strings.TrimSuffix(fileName, ".c4gh")
+	}
+	return fileName + ".dec"
+}
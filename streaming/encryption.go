@@ -0,0 +1,107 @@
+package streaming
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"os"
+
+	"github.com/neicnordic/crypt4gh/model/headers"
+	crypt4gh "github.com/neicnordic/crypt4gh/streaming"
+)
+
+// segmentOverhead is the number of bytes the nonce and the MAC add to every encrypted data segment.
+const segmentOverhead = 12 + 16
+
+// uploadSource structure represents the stream of bytes being uploaded for a local file.
+type uploadSource struct {
+	reader          io.Reader
+	size            int64
+	plaintextSHA256 hash.Hash
+	plaintextMD5    hash.Hash
+}
+
+// openSource prepares the bytes of the file to upload, starting from the offset: either the Crypt4GH file itself or,
+// if the recipient public key is set, the plaintext file encrypted on the fly.
+func (s defaultStreamer) openSource(file *os.File, stat os.FileInfo, offset int64) (*uploadSource, error) {
+	if s.publicKey == nil {
+		// Make sure the file to be uploaded is a crypt4gh encrypted file
+		if err := isCrypt4GHFile(file); err != nil {
+			return nil, err
+		}
+		if err := s.checkRecipient(file); err != nil {
+			return nil, err
+		}
+		if _, err := file.Seek(offset, 0); err != nil {
+			return nil, err
+		}
+		return &uploadSource{reader: file, size: stat.Size()}, nil
+	}
+	if _, err := headers.ReadHeader(file); err == nil {
+		return nil, errors.New(file.Name() + ": already a Crypt4GH file, upload it without --encrypt")
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	size, err := encryptedSize(stat.Size(), *s.publicKey)
+	if err != nil {
+		return nil, err
+	}
+	source := uploadSource{size: size, plaintextSHA256: sha256.New(), plaintextMD5: md5.New()}
+	pipeReader, pipeWriter := io.Pipe()
+	source.reader = pipeReader
+	go func() {
+		writer, err := crypt4gh.NewCrypt4GHWriterWithoutPrivateKey(pipeWriter, [][32]byte{*s.publicKey}, nil)
+		if err == nil {
+			_, err = io.Copy(writer, io.TeeReader(file, io.MultiWriter(source.plaintextSHA256, source.plaintextMD5)))
+		}
+		if err == nil {
+			err = writer.Close()
+		}
+		_ = pipeWriter.CloseWithError(err)
+	}()
+	return &source, nil
+}
+
+// close stops the encryption, if it is still running.
+func (us *uploadSource) close() {
+	if pipeReader, ok := us.reader.(*io.PipeReader); ok {
+		_ = pipeReader.Close()
+	}
+}
+
+// addPlaintextChecksums records the checksums of the plaintext of the file encrypted during the upload.
+func (us *uploadSource) addPlaintextChecksums(uploadedFile *UploadedFile) {
+	if us.plaintextSHA256 == nil {
+		return
+	}
+	uploadedFile.PlaintextSHA256 = hex.EncodeToString(us.plaintextSHA256.Sum(nil))
+	uploadedFile.PlaintextMD5 = hex.EncodeToString(us.plaintextMD5.Sum(nil))
+}
+
+// encryptedSize returns the size of the plaintext of the given size, once encrypted for the recipient.
+func encryptedSize(plaintextSize int64, publicKey [32]byte) (int64, error) {
+	header := &countingWriter{}
+	if _, err := crypt4gh.NewCrypt4GHWriterWithoutPrivateKey(header, [][32]byte{publicKey}, nil); err != nil {
+		return 0, err
+	}
+	segmentSize := int64(headers.UnencryptedDataSegmentSize)
+	segments := (plaintextSize + segmentSize - 1) / segmentSize
+	if segments == 0 {
+		// Even an empty file gets a single empty segment.
+		segments = 1
+	}
+	return header.written + plaintextSize + segments*segmentOverhead, nil
+}
+
+type countingWriter struct {
+	written int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	cw.written += int64(len(p))
+	return len(p), nil
+}
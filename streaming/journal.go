@@ -0,0 +1,263 @@
+package streaming
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/elixir-oslo/lega-commander/resuming"
+	aurora "github.com/logrusorgru/aurora/v3"
+)
+
+// NothingToResumeError is returned when the upload of the file is to be resumed, but no interrupted upload of it is
+// found.
+type NothingToResumeError struct {
+	Path     string
+	FileName string
+}
+
+// Error returns the message telling there is nothing to resume.
+func (e *NothingToResumeError) Error() string {
+	return "Nothing to resume for " + e.Path + ": no interrupted upload of " + e.FileName +
+		" is found, upload it without --resume."
+}
+
+// resumePoint finds the interrupted upload of the file and returns its upload ID along with the checkpoint to resume
+// it from. The upload recorded in the journal is looked up among the resumable ones by its ID and is only resumed if
+// the local file has not changed since; without the journal entry the resumable upload is looked up by the name of
+// the file in the inbox. As the chunks are sent in order, the upload is resumed right after the last chunk the server
+// has received, even if the journal has not recorded it yet.
+func (s defaultStreamer) resumePoint(ctx context.Context, path, fileName string, stat os.FileInfo) (*string, checkpoint, error) {
+	entry, err := s.journal.Load(fileName)
+	if err != nil {
+		return nil, checkpoint{}, err
+	}
+	resumables, err := s.resumablesManager.ListResumables(ctx)
+	if err != nil {
+		return nil, checkpoint{}, err
+	}
+	var resumable *resuming.Resumable
+	for i, candidate := range *resumables {
+		if entry != nil && candidate.ID == entry.UploadID || entry == nil && candidate.Name == fileName {
+			resumable = &(*resumables)[i]
+			break
+		}
+	}
+	if entry != nil {
+		if resumable == nil {
+			if err = s.journal.Delete(fileName); err != nil {
+				return nil, checkpoint{}, err
+			}
+			return nil, checkpoint{}, errors.New("Upload " + entry.UploadID + " of " + path +
+				" is not resumable anymore, upload the file without --resume.")
+		}
+		if entry.Changed(stat) {
+			return nil, checkpoint{}, errors.New("File " + path + " has changed since its upload " + entry.UploadID +
+				" was interrupted, delete the resumable upload and upload the file without --resume.")
+		}
+	}
+	if resumable == nil {
+		return nil, checkpoint{}, &NothingToResumeError{path, fileName}
+	}
+	start := checkpoint{chunk: resumable.Chunk, offset: resumable.Size}
+	if entry != nil && entry.Offset == resumable.Size && entry.Chunk+1 == resumable.Chunk {
+		start.sha256State, start.md5State = entry.SHA256State, entry.MD5State
+	}
+	return &resumable.ID, start, nil
+}
+
+// resumedHashes returns the hash functions of the upload fed with the bytes of the file before the checkpoint, so that
+// the checksums cover the whole file: the states recorded in the journal are restored if they are available, otherwise
+// the part of the file that has already been sent is read again.
+func resumedHashes(file *os.File, start checkpoint) (*fileHashes, error) {
+	hashes := newFileHashes()
+	if start.sha256State != nil {
+		if err := hashes.restore(start); err != nil {
+			return nil, errors.New("hash state of the interrupted upload can not be restored: " + err.Error())
+		}
+		return hashes, nil
+	}
+	if start.offset == 0 {
+		return hashes, nil
+	}
+	read, err := io.Copy(hashes, io.NewSectionReader(file, 0, start.offset))
+	if err != nil {
+		return nil, errors.New(file.Name() + ": " + err.Error())
+	}
+	if read != start.offset {
+		return nil, errors.New("File " + file.Name() + " is shorter than the " + strconv.FormatInt(start.offset, 10) +
+			" bytes already uploaded, delete the resumable upload and upload the file without --resume.")
+	}
+	return hashes, nil
+}
+
+// recordProgress returns the function recording the progress of the upload of the file in the journal, nil for the
+// uploads encrypted on the fly, as they can not be resumed.
+func (s defaultStreamer) recordProgress(file *os.File, fileName string, stat os.FileInfo) progressRecorder {
+	if s.publicKey != nil {
+		return nil
+	}
+	path, err := filepath.Abs(file.Name())
+	if err != nil {
+		path = file.Name()
+	}
+	return func(uploadID string, c checkpoint) error {
+		return s.journal.Store(resuming.JournalEntry{
+			Path:        path,
+			FileName:    fileName,
+			Size:        stat.Size(),
+			ModTime:     stat.ModTime(),
+			UploadID:    uploadID,
+			Chunk:       c.chunk - 1,
+			Offset:      c.offset,
+			SHA256State: c.sha256State,
+			MD5State:    c.md5State,
+		})
+	}
+}
+
+// ResumeAll method resumes all the interrupted uploads listed by the server. The local file of an upload is the one
+// recorded in the journal, if it is still there, otherwise the file found in the directories, searched recursively,
+// by the name and by the size being at least the number of bytes already uploaded. The uploads the local files of
+// which can not be found are reported in UploadFailuresError along with the ones that fail.
+func (s defaultStreamer) ResumeAll(ctx context.Context, directories []string, options UploadOptions) error {
+	if err := s.prepareRecipientCheck(ctx, options); err != nil {
+		return err
+	}
+	resumables, err := s.resumablesManager.ListResumables(ctx)
+	if err != nil {
+		return err
+	}
+	if len(*resumables) == 0 {
+		fmt.Println(aurora.Yellow("Nothing to resume"))
+		return nil
+	}
+	journalEntries, err := s.journal.List()
+	if err != nil {
+		return err
+	}
+	recorded := make(map[string]resuming.JournalEntry, len(journalEntries))
+	for _, entry := range journalEntries {
+		recorded[entry.UploadID] = entry
+	}
+	localFiles, err := listLocalFiles(directories)
+	if err != nil {
+		return err
+	}
+	entries := make([]folderEntry, 0, len(*resumables))
+	var failures []FailedUpload
+	for _, resumable := range *resumables {
+		path, err := localSource(resumable, recorded, localFiles)
+		if err != nil {
+			failures = append(failures, FailedUpload{resumable.Name, resumable.Name, err})
+			continue
+		}
+		entries = append(entries, folderEntry{path, resumable.Name})
+	}
+	options.Resume = true
+	return s.uploadEntries(ctx, entries, failures, options)
+}
+
+// localFile structure represents a file found in one of the directories to resume the uploads from.
+type localFile struct {
+	path         string
+	relativePath string
+	size         int64
+}
+
+// listLocalFiles lists the files of the directories and their subdirectories, grouped by their names.
+func listLocalFiles(directories []string) (map[string][]localFile, error) {
+	localFiles := make(map[string][]localFile)
+	for _, directory := range directories {
+		err := filepath.WalkDir(directory, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			abs, err := filepath.Abs(path)
+			if err != nil {
+				return err
+			}
+			relativePath, err := filepath.Rel(directory, path)
+			if err != nil {
+				return err
+			}
+			localFiles[d.Name()] = append(localFiles[d.Name()], localFile{abs, filepath.ToSlash(relativePath), info.Size()})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return localFiles, nil
+}
+
+// localSource returns the path of the local file of the interrupted upload: the one recorded in the journal if it
+// still exists, otherwise the only file with the same name that is not shorter than the uploaded part. Files sharing
+// the name are told apart by their paths relative to the directories, which recursive uploads keep in the inbox: the
+// ones with the most trailing path components in common with the name in the inbox are preferred.
+func localSource(resumable resuming.Resumable, recorded map[string]resuming.JournalEntry, localFiles map[string][]localFile) (string, error) {
+	if entry, ok := recorded[resumable.ID]; ok {
+		if _, err := os.Stat(entry.Path); err == nil {
+			return entry.Path, nil
+		}
+	}
+	candidates := make([]localFile, 0)
+	for _, candidate := range localFiles[path.Base(resumable.Name)] {
+		if candidate.size >= resumable.Size {
+			candidates = append(candidates, candidate)
+		}
+	}
+	if len(candidates) > 1 {
+		closest, longest := make([]localFile, 0), 0
+		for _, candidate := range candidates {
+			matching := matchingComponents(resumable.Name, candidate.relativePath)
+			if matching > longest {
+				closest, longest = closest[:0], matching
+			}
+			if matching == longest {
+				closest = append(closest, candidate)
+			}
+		}
+		candidates = closest
+	}
+	switch len(candidates) {
+	case 0:
+		return "", errors.New("no local file of upload " + resumable.ID + " is found: " + path.Base(resumable.Name) +
+			" of at least " + strconv.FormatInt(resumable.Size, 10) + " bytes is expected")
+	case 1:
+		return candidates[0].path, nil
+	default:
+		paths := make([]string, 0, len(candidates))
+		for _, candidate := range candidates {
+			paths = append(paths, candidate.path)
+		}
+		return "", errors.New("local file of upload " + resumable.ID + " is ambiguous, it may be any of " +
+			strings.Join(paths, ", "))
+	}
+}
+
+// matchingComponents counts the trailing components the name of the file in the inbox and the relative path have in
+// common.
+func matchingComponents(fileName, relativePath string) int {
+	nameComponents, pathComponents := strings.Split(fileName, "/"), strings.Split(relativePath, "/")
+	matching := 0
+	for matching < len(nameComponents) && matching < len(pathComponents) &&
+		nameComponents[len(nameComponents)-1-matching] == pathComponents[len(pathComponents)-1-matching] {
+		matching++
+	}
+	return matching
+}
@@ -0,0 +1,69 @@
+package streaming
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UploadedFile structure represents a file uploaded to the inbox, as listed in the manifest.
+type UploadedFile struct {
+	FileName  string    `json:"fileName"`
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+	MD5       string    `json:"md5"`
+	UploadID  string    `json:"uploadId"`
+	Timestamp time.Time `json:"timestamp"`
+	// ChecksumConfirmed tells whether the server confirmed the SHA-256 checksum of the assembled file.
+	ChecksumConfirmed bool `json:"checksumConfirmed"`
+	// PlaintextSHA256 and PlaintextMD5 are only set for files encrypted during the upload.
+	PlaintextSHA256 string `json:"plaintextSha256,omitempty"`
+	PlaintextMD5    string `json:"plaintextMd5,omitempty"`
+}
+
+func newUploadedFile(file *os.File, fileName string, size int64, checksum string, md5HashFunction hash.Hash, uploadID string) *UploadedFile {
+	return &UploadedFile{
+		FileName:  fileName,
+		Path:      file.Name(),
+		Size:      size,
+		SHA256:    checksum,
+		MD5:       hex.EncodeToString(md5HashFunction.Sum(nil)),
+		UploadID:  uploadID,
+		Timestamp: time.Now().UTC(),
+	}
+}
+
+// writeManifest writes the list of the uploaded files both as JSON and as TSV, to the files with the corresponding
+// extensions added to the given path.
+func writeManifest(path string, uploadedFiles []UploadedFile) error {
+	jsonManifest, err := json.MarshalIndent(uploadedFiles, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path+".json", append(jsonManifest, '\n'), 0644)
+	if err != nil {
+		return err
+	}
+	lines := []string{"fileName\tpath\tsize\tsha256\tmd5\tuploadId\ttimestamp\tplaintextSha256\tplaintextMd5\tchecksumConfirmed"}
+	for _, uploadedFile := range uploadedFiles {
+		lines = append(lines, strings.Join([]string{
+			uploadedFile.FileName,
+			uploadedFile.Path,
+			strconv.FormatInt(uploadedFile.Size, 10),
+			uploadedFile.SHA256,
+			uploadedFile.MD5,
+			uploadedFile.UploadID,
+			uploadedFile.Timestamp.Format(time.RFC3339),
+			uploadedFile.PlaintextSHA256,
+			uploadedFile.PlaintextMD5,
+			strconv.FormatBool(uploadedFile.ChecksumConfirmed),
+		}, "\t"))
+	}
+	return ioutil.WriteFile(path+".tsv", []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
@@ -0,0 +1,81 @@
+package streaming
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/elixir-oslo/lega-commander/c4gh"
+	"github.com/elixir-oslo/lega-commander/requests"
+	"github.com/neicnordic/crypt4gh/keys"
+)
+
+// readIngestionKey reads the public key files have to be encrypted for, either from the local file or from the URL.
+func (s defaultStreamer) readIngestionKey(ctx context.Context, location string) (*[32]byte, error) {
+	if !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://") {
+		return c4gh.ReadPublicKey(location)
+	}
+	response, err := s.client.DoRequest(ctx, http.MethodGet, location, nil, nil, nil, "", "")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if err = requests.CheckResponse(response); err != nil {
+		return nil, fmt.Errorf("%v: %w", location, err)
+	}
+	publicKey, err := keys.ReadPublicKey(response.Body)
+	if err != nil {
+		return nil, errors.New(location + ": " + err.Error())
+	}
+	return &publicKey, nil
+}
+
+// recipientKey returns the public key to encrypt files for during the upload: the one read from the path if given,
+// the ingestion key otherwise. A key other than the ingestion key is refused once the latter is known.
+func (s defaultStreamer) recipientKey(path string) (*[32]byte, error) {
+	if path == "" {
+		if s.ingestionKey == nil {
+			return nil, errors.New("public key of the recipient is required for encryption, use --pubkey")
+		}
+		return s.ingestionKey, nil
+	}
+	publicKey, err := c4gh.ReadPublicKey(path)
+	if err != nil {
+		return nil, err
+	}
+	if s.ingestionKey != nil && *publicKey != *s.ingestionKey {
+		return nil, errors.New(path + ": not the ingestion key " + c4gh.Fingerprint(*s.ingestionKey) +
+			" the files have to be encrypted for")
+	}
+	return publicKey, nil
+}
+
+// checkRecipient makes sure the Crypt4GH file is encrypted for the ingestion key, if the key is known. A file written
+// with a key none of the given private keys matches is refused, as it can not be checked: such a key is usually an
+// ephemeral one, thrown away right after the encryption, and then only the holder of the ingestion key can tell the
+// recipient.
+func (s defaultStreamer) checkRecipient(file *os.File) error {
+	if s.ingestionKey == nil {
+		return nil
+	}
+	header, err := c4gh.InspectHeader(file)
+	if err != nil {
+		return errors.New(file.Name() + ": " + err.Error())
+	}
+	addressed, err := header.IsAddressedTo(*s.ingestionKey, s.writerPrivateKeys...)
+	var unknownWriterError *c4gh.UnknownWriterError
+	if errors.As(err, &unknownWriterError) {
+		return errors.New(file.Name() + ": can not check the file is encrypted for the ingestion key, " + err.Error() +
+			"; use --writer-seckey to give it, or --no-recipient-check if it is an ephemeral key")
+	}
+	if err != nil {
+		return err
+	}
+	if !addressed {
+		return errors.New(file.Name() + ": not encrypted for the ingestion key " + c4gh.Fingerprint(*s.ingestionKey))
+	}
+	return nil
+}
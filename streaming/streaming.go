@@ -2,20 +2,22 @@
 package streaming
 
 import (
-	"bytes"
-	"crypto/md5"
-	"crypto/sha256"
+	"context"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/buger/jsonparser"
 	"github.com/cheggaaa/pb/v3"
@@ -30,19 +32,96 @@ import (
 
 // Streamer interface provides methods for uploading and downloading files from LocalEGA instance.
 type Streamer interface {
-	Upload(path string, resume, straight bool) error
-	uploadFolder(folder *os.File, resume bool, straight bool) error
-	uploadFile(file *os.File, stat os.FileInfo, uploadID *string, offset int64, startChunk int64) error
-	Download(fileName string) error
+	Upload(ctx context.Context, path string, options UploadOptions) error
+	uploadFolder(ctx context.Context, folder *os.File, options UploadOptions) error
+	uploadFile(ctx context.Context, file *os.File, fileName string, stat os.FileInfo, uploadID *string, start checkpoint) (*UploadedFile, error)
+	Download(ctx context.Context, fileName string, options DownloadOptions) error
+	Verify(ctx context.Context, path string, options UploadOptions) error
+	ResumeAll(ctx context.Context, directories []string, options UploadOptions) error
 }
 
 type defaultStreamer struct {
 	client            requests.Client
 	fileManager       files.FileManager
 	resumablesManager resuming.ResumablesManager
-	tsd_token         string
-	claims            jwt.MapClaims
+	journal           *resuming.Journal
+	tsdToken          *tsdToken
+	bar               *pb.ProgressBar
+	// inbox is the listing of the inbox fetched once for all the files uploaded together, nil if it is not fetched.
+	inbox *[]files.File
+	// warnings collects the warnings of the file uploaded by a worker of a parallel folder upload, printed once the
+	// progress bars are stopped; nil if the warnings are printed right away.
+	warnings          *[]string
+	publicKey         *[32]byte
+	ingestionKey      *[32]byte
+	writerPrivateKeys [][32]byte
 }
+
+// UploadOptions structure holds the settings of an upload.
+type UploadOptions struct {
+	// Resume resumes the interrupted upload instead of starting a new one.
+	Resume bool
+	// Straight uploads the files directly to TSD File API, bypassing the proxy.
+	Straight bool
+	// Parallel is the number of files of a folder to upload at once.
+	Parallel int
+	// Recursive uploads the subfolders too, using paths relative to the uploaded folder as names in the inbox.
+	Recursive bool
+	// Prefix is prepended to the names of the files in the inbox.
+	Prefix string
+	// Include lists glob patterns, one of which a file of a folder has to match in order to be uploaded.
+	Include []string
+	// Exclude lists glob patterns of files and subfolders of a folder to skip.
+	Exclude []string
+	// Verify checks every uploaded file against the inbox listing once the upload is finished.
+	Verify bool
+	// Manifest is the path, without extension, of the JSON and TSV manifests of the uploaded files to write. The files
+	// that fail the verification are left out.
+	Manifest string
+	// Encrypt encrypts plaintext files during the upload, for PublicKey or, if it is not set, for the ingestion key.
+	Encrypt bool
+	// PublicKey is the path to the public key of the recipient to encrypt plaintext files for during the upload.
+	PublicKey string
+	// WriterPrivateKeys are the private keys the Crypt4GH files were encrypted with, needed to check their recipient.
+	WriterPrivateKeys [][32]byte
+	// SkipRecipientCheck uploads Crypt4GH files without checking they are encrypted for the ingestion key.
+	SkipRecipientCheck bool
+}
+
+// DownloadOptions structure holds the settings of a download.
+type DownloadOptions struct {
+	// Resume appends the rest of the file to the partially downloaded local one.
+	Resume bool
+	// PrivateKey, if set, is used to decrypt the file during the download.
+	PrivateKey *[32]byte
+}
+
+// FailedUpload structure represents a file that could not be uploaded.
+type FailedUpload struct {
+	Path string
+	// FileName is the name of the file in the inbox, which tells apart the files of the same name in different folders.
+	FileName string
+	Err      error
+}
+
+// UploadFailuresError is returned when some of the files of a folder could not be uploaded.
+type UploadFailuresError struct {
+	Total    int
+	Failures []FailedUpload
+}
+
+// Error returns the summary of the failed uploads.
+func (e *UploadFailuresError) Error() string {
+	summary := fmt.Sprintf("%d of %d files failed to upload:", len(e.Failures), e.Total)
+	for _, failure := range e.Failures {
+		summary += "\n  " + failure.FileName + ": " + failure.Err.Error()
+	}
+	return summary
+}
+
+// errNotStarted is the failure of the files of a folder that were not started because the upload is interrupted.
+var errNotStarted = errors.New("upload is interrupted before the file is started")
+
 type ResponseJson struct {
 	// defining token response that comes from tsd proxy
 	StatusCode int    `json:"statusCode"`
@@ -50,8 +129,9 @@ type ResponseJson struct {
 	Token      string `json:"token"`
 }
 
-// NewStreamer method constructs Streamer structure.
-func NewStreamer(client *requests.Client, fileManager *files.FileManager, resumablesManager *resuming.ResumablesManager, straight bool) (Streamer, error) {
+// NewStreamer method constructs Streamer structure. The context is used to request the TSD token for straight
+// uploads.
+func NewStreamer(ctx context.Context, client *requests.Client, fileManager *files.FileManager, resumablesManager *resuming.ResumablesManager, straight bool) (Streamer, error) {
 	streamer := defaultStreamer{}
 	if client != nil {
 		streamer.client = *client
@@ -77,179 +157,524 @@ func NewStreamer(client *requests.Client, fileManager *files.FileManager, resuma
 		streamer.resumablesManager = newResumablesManager
 	}
 	configuration := conf.NewConfiguration()
-	var err error
+	streamer.journal = resuming.NewJournal(configuration.GetResumeJournalDirectory())
 	if straight {
-		streamer.tsd_token, streamer.claims, err = streamer.getTSDtoken(configuration)
+		fmt.Println("asking for tsd connection details from proxy service...")
+		if configuration.GetTSDTokenKey() == "" && configuration.GetTSDTokenJWKSURL() == "" {
+			fmt.Println(aurora.Yellow("WARNING: the signature of the TSD token is not checked, set tsd_token_key or " +
+				"tsd_token_jwks_url to check it"))
+		}
+		token, claims, err := streamer.getTSDtoken(ctx, configuration)
+		if err != nil {
+			return nil, err
+		}
+		streamer.tsdToken = newTSDToken(token, claims, func(ctx context.Context) (string, jwt.MapClaims, error) {
+			return streamer.getTSDtoken(ctx, configuration)
+		})
 	}
+	return streamer, nil
+}
+
+// Upload method uploads file or folder to LocalEGA. Once the context is done, the upload stops after the chunks being
+// sent and InterruptedUploadError tells where to resume it from.
+func (s defaultStreamer) Upload(ctx context.Context, path string, options UploadOptions) error {
+	stat, err := os.Stat(path)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return streamer, nil
+	if err = s.prepareRecipientCheck(ctx, options); err != nil {
+		return err
+	}
+	if options.Encrypt {
+		if options.Resume {
+			return errors.New("uploads encrypted on the fly can not be resumed")
+		}
+		if s.publicKey, err = s.recipientKey(options.PublicKey); err != nil {
+			return err
+		}
+	}
+	if stat.IsDir() {
+		folder, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer folder.Close()
+		return s.uploadFolder(ctx, folder, options)
+	}
+	uploadedFile, err := s.uploadPath(ctx, path, inboxFileName(options.Prefix, filepath.Base(path)), options)
+	if err != nil {
+		return err
+	}
+	if options.Verify {
+		if err = s.verifyUploadedFiles(ctx, []UploadedFile{*uploadedFile}); err != nil {
+			return err
+		}
+	}
+	if options.Manifest != "" {
+		return writeManifest(options.Manifest, []UploadedFile{*uploadedFile})
+	}
+	return nil
 }
 
-// Upload method uploads file or folder to LocalEGA.
-func (s defaultStreamer) Upload(path string, resume, straight bool) error {
-	file, err := os.Open(path)
+// prepareRecipientCheck reads the ingestion key, if it is configured, so that the uploaded Crypt4GH files are checked
+// to be encrypted for it, unless the check is skipped.
+func (s *defaultStreamer) prepareRecipientCheck(ctx context.Context, options UploadOptions) error {
+	location := conf.NewConfiguration().GetIngestionPublicKey()
+	if location == "" || options.SkipRecipientCheck {
+		return nil
+	}
+	ingestionKey, err := s.readIngestionKey(ctx, location)
 	if err != nil {
 		return err
 	}
+	s.ingestionKey = ingestionKey
+	s.writerPrivateKeys = options.WriterPrivateKeys
+	return nil
+}
+
+// uploadPath uploads a single file, storing it under the given name in the inbox, with .c4gh suffix added to the
+// name if the file gets encrypted during the upload.
+func (s defaultStreamer) uploadPath(ctx context.Context, path, fileName string, options UploadOptions) (*UploadedFile, error) {
+	if s.publicKey != nil {
+		fileName += ".c4gh"
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
 	defer file.Close()
 	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	uploadID, start := (*string)(nil), checkpoint{chunk: 1}
+	if options.Resume {
+		if uploadID, start, err = s.resumePoint(ctx, path, fileName, stat); err != nil {
+			return nil, err
+		}
+	}
+	if !options.Straight {
+		return s.uploadFile(ctx, file, fileName, stat, uploadID, start)
+	}
+	return s.uploadFileWithoutProxy(ctx, file, fileName, stat, uploadID, start)
+}
+
+func (s defaultStreamer) uploadFolder(ctx context.Context, folder *os.File, options UploadOptions) error {
+	entries, err := listFolder(folder.Name(), options)
 	if err != nil {
 		return err
 	}
-	if stat.IsDir() {
-		return s.uploadFolder(file, resume, straight)
+	entries, failures := sameNameEntries(entries)
+	return s.uploadEntries(ctx, entries, failures, options)
+}
+
+// uploadEntries uploads the files using options.Parallel workers, each with a progress bar of its own when there is
+// more than one. The inbox is listed once before the upload, to check none of the files is already there, and once
+// after it, to verify all the uploaded files. The files that could not be uploaded or verified are reported in
+// UploadFailuresError along with the given failures, which are counted among the files too.
+func (s defaultStreamer) uploadEntries(ctx context.Context, entries []folderEntry, failures []FailedUpload, options UploadOptions) error {
+	alreadyFailed := len(failures)
+	workers := options.Parallel
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(entries) {
+		workers = len(entries)
+	}
+	var overallBar *pb.ProgressBar
+	var pool *pb.Pool
+	bars := make([]*pb.ProgressBar, workers)
+	if workers > 1 {
+		for i := range bars {
+			bars[i] = pb.New64(0)
+		}
+		overallBar = pb.New(len(entries)).Set("prefix", "Total files")
+		var err error
+		if pool, err = pb.StartPool(append(bars, overallBar)...); err != nil {
+			pool = nil
+		}
 	}
-	if resume {
-		fileName := filepath.Base(file.Name())
-		resumablesList, err := s.resumablesManager.ListResumables()
-		if err != nil {
-			return err
+	if len(entries) != 0 {
+		if inbox, err := s.fileManager.ListFiles(ctx, true); err == nil {
+			s.inbox = inbox
 		}
-		for _, resumable := range *resumablesList {
-			if resumable.Name == fileName {
-				if !straight {
-					return s.uploadFile(file, stat, &resumable.ID, resumable.Size, resumable.Chunk)
-				} else {
-					return s.uploadFileWithoutProxy(file, stat, &resumable.ID, resumable.Size, resumable.Chunk)
+	}
+	queue := make(chan folderEntry)
+	var mutex sync.Mutex
+	var notResumed []string
+	var uploadedFiles []UploadedFile
+	var warnings []string
+	var wg sync.WaitGroup
+	for _, bar := range bars {
+		wg.Add(1)
+		worker := s
+		worker.bar = bar
+		go func() {
+			defer wg.Done()
+			for entry := range queue {
+				var uploadedFile *UploadedFile
+				var fileWarnings []string
+				if bar != nil {
+					worker.warnings = &fileWarnings
+				}
+				err := errNotStarted
+				if ctx.Err() == nil {
+					uploadedFile, err = worker.uploadPath(ctx, entry.path, entry.fileName, options)
+				}
+				mutex.Lock()
+				warnings = append(warnings, fileWarnings...)
+				var nothingToResume *NothingToResumeError
+				if uploadedFile != nil {
+					uploadedFiles = append(uploadedFiles, *uploadedFile)
+				}
+				if errors.As(err, &nothingToResume) {
+					notResumed = append(notResumed, entry.path)
+				} else if err != nil {
+					failures = append(failures, FailedUpload{entry.path, entry.fileName, err})
+				}
+				mutex.Unlock()
+				if overallBar != nil {
+					overallBar.Increment()
 				}
-
 			}
+		}()
+	}
+	queued := 0
+queueing:
+	for _, entry := range entries {
+		select {
+		case queue <- entry:
+			queued++
+		case <-ctx.Done():
+			break queueing
 		}
-		return nil
 	}
-	if !straight {
-		return s.uploadFile(file, stat, nil, 0, 1)
-	} else {
-		return s.uploadFileWithoutProxy(file, stat, nil, 0, 1)
+	close(queue)
+	wg.Wait()
+	for _, entry := range entries[queued:] {
+		failures = append(failures, FailedUpload{entry.path, entry.fileName, errNotStarted})
+	}
+	if overallBar != nil {
+		for _, bar := range bars {
+			bar.Set("prefix", "Done").Finish()
+		}
+		overallBar.Finish()
+	}
+	if pool != nil {
+		_ = pool.Stop()
+	}
+	for _, warning := range warnings {
+		fmt.Println(aurora.Yellow(warning))
+	}
+	for _, path := range notResumed {
+		fmt.Println(aurora.Yellow("Nothing to resume for " + path))
+	}
+	if options.Verify && len(uploadedFiles) != 0 {
+		err := s.verifyUploadedFiles(ctx, uploadedFiles)
+		var verificationError *VerificationError
+		if errors.As(err, &verificationError) {
+			uploadedFiles = withoutMismatches(uploadedFiles, verificationError.Mismatches, func(path string, mismatch Mismatch) {
+				failures = append(failures, FailedUpload{path, mismatch.FileName, &VerificationError{[]Mismatch{mismatch}}})
+			})
+		} else if err != nil {
+			return err
+		}
 	}
+	if options.Manifest != "" && len(uploadedFiles) != 0 {
+		if err := writeManifest(options.Manifest, uploadedFiles); err != nil {
+			return err
+		}
+	}
+	if len(failures) != 0 {
+		return &UploadFailuresError{len(entries) + alreadyFailed, failures}
+	}
+	return nil
 }
 
-func (s defaultStreamer) uploadFolder(folder *os.File, resume, straight bool) error {
-	readdir, err := folder.Readdir(-1)
-	if err != nil {
-		return err
+// withoutMismatches returns the uploaded files except the ones that do not match the inbox, which are passed to
+// failed along with their local paths, so that the manifest only lists the verified files.
+func withoutMismatches(uploadedFiles []UploadedFile, mismatches []Mismatch, failed func(path string, mismatch Mismatch)) []UploadedFile {
+	mismatching := make(map[string]Mismatch, len(mismatches))
+	for _, mismatch := range mismatches {
+		mismatching[mismatch.FileName] = mismatch
+	}
+	verified := make([]UploadedFile, 0, len(uploadedFiles))
+	for _, uploadedFile := range uploadedFiles {
+		if mismatch, ok := mismatching[uploadedFile.FileName]; ok {
+			failed(uploadedFile.Path, mismatch)
+			continue
+		}
+		verified = append(verified, uploadedFile)
 	}
-	for _, file := range readdir {
-		abs, err := filepath.Abs(filepath.Join(folder.Name(), file.Name()))
+	return verified
+}
+
+// folderEntry structure represents a file of the uploaded folder along with its name in the inbox.
+type folderEntry struct {
+	path     string
+	fileName string
+}
+
+// listFolder lists the files of the folder and its subfolders to upload, filtered by the include and exclude patterns.
+// In the recursive mode the files keep their paths relative to the folder as their names in the inbox, otherwise they
+// are named after themselves only.
+func listFolder(root string, options UploadOptions) ([]folderEntry, error) {
+	for _, pattern := range append(options.Include, options.Exclude...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, errors.New(pattern + ": " + err.Error())
+		}
+	}
+	entries := make([]folderEntry, 0)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		relativePath, err := filepath.Rel(root, path)
 		if err != nil {
 			return err
 		}
-		err = s.Upload(abs, resume, straight)
+		if matchesAny(options.Exclude, relativePath) {
+			return skipDir(d)
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if len(options.Include) != 0 && !matchesAny(options.Include, relativePath) {
+			return nil
+		}
+		abs, err := filepath.Abs(path)
 		if err != nil {
 			return err
 		}
+		fileName := filepath.ToSlash(relativePath)
+		if !options.Recursive {
+			fileName = d.Name()
+		}
+		entries = append(entries, folderEntry{abs, inboxFileName(options.Prefix, fileName)})
+		return nil
+	})
+	return entries, err
+}
+
+// sameNameEntries separates the files that would get the same name in the inbox as a file listed before them, which
+// happens to the files of different subfolders outside of the recursive mode, and returns them as failed.
+func sameNameEntries(entries []folderEntry) ([]folderEntry, []FailedUpload) {
+	paths := make(map[string]string, len(entries))
+	unique := make([]folderEntry, 0, len(entries))
+	var failures []FailedUpload
+	for _, entry := range entries {
+		if path, ok := paths[entry.fileName]; ok {
+			failures = append(failures, FailedUpload{entry.path, entry.fileName, errors.New(entry.path +
+				" would be uploaded under the same name as " + path + ", use --recursive to keep the relative paths in the inbox")})
+			continue
+		}
+		paths[entry.fileName] = entry.path
+		unique = append(unique, entry)
+	}
+	return unique, failures
+}
+
+// matchesAny checks whether either the relative path or the name of the file matches any of the glob patterns.
+func matchesAny(patterns []string, relativePath string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, relativePath); matched {
+			return true
+		}
+		if matched, _ := filepath.Match(pattern, filepath.Base(relativePath)); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func skipDir(d fs.DirEntry) error {
+	if d.IsDir() {
+		return fs.SkipDir
 	}
 	return nil
 }
 
-func (s defaultStreamer) uploadFile(file *os.File, stat os.FileInfo, uploadID *string, offset, startChunk int64) error {
-	fileName := filepath.Base(file.Name())
+// inboxFileName prepends the prefix, if any, to the name of the file in the inbox.
+func inboxFileName(prefix, fileName string) string {
+	if prefix == "" {
+		return fileName
+	}
+	return path.Join(filepath.ToSlash(prefix), fileName)
+}
+
+// isSameFile checks whether the name of the file listed in the inbox is the name of the uploaded file, comparing the
+// whole paths relative to the inbox.
+func isSameFile(listedFileName, fileName string) bool {
+	return strings.TrimPrefix(listedFileName, "/") == strings.TrimPrefix(fileName, "/")
+}
+
+// startProgressBar starts the progress bar of the file upload. Within a parallel folder upload the bar of the worker
+// is reused instead, as the pool of bars is already rendered.
+func (s defaultStreamer) startProgressBar(file *os.File, totalSize, offset int64) *pb.ProgressBar {
+	if s.bar != nil {
+		s.bar.Set("prefix", filepath.Base(file.Name()))
+		s.bar.SetTotal(totalSize)
+		s.bar.SetCurrent(offset)
+		return s.bar
+	}
+	fmt.Println(aurora.Blue("Uploading file: " + file.Name() + " (" + strconv.FormatInt(totalSize, 10) + " bytes)"))
+	bar := pb.StartNew(100)
+	bar.SetTotal(totalSize)
+	bar.SetCurrent(offset)
+	bar.Start()
+	return bar
+}
+
+// finishProgressBar finishes the progress bar of the file upload, unless it belongs to a worker of a folder upload.
+func (s defaultStreamer) finishProgressBar(bar *pb.ProgressBar) {
+	if s.bar == nil {
+		bar.Finish()
+	}
+}
+
+// report prints a note about the progress of the upload, unless it would break the progress bars of a folder upload.
+// Warnings, which must not be lost, go through warn instead.
+func (s defaultStreamer) report(message string) {
+	if s.bar == nil {
+		fmt.Println(message)
+	}
+}
+
+// warn prints the warning about the upload, or keeps it for later if the upload is one of a parallel folder upload,
+// so that it does not break the progress bars.
+func (s defaultStreamer) warn(message string) {
+	if s.warnings != nil {
+		*s.warnings = append(*s.warnings, message)
+		return
+	}
+	fmt.Println(aurora.Yellow(message))
+}
+
+// inboxListing returns the listing of the inbox fetched for all the files uploaded together, or lists the inbox if
+// there is none.
+func (s defaultStreamer) inboxListing(ctx context.Context) (*[]files.File, error) {
+	if s.inbox != nil {
+		return s.inbox, nil
+	}
+	return s.fileManager.ListFiles(ctx, true)
+}
+
+func (s defaultStreamer) uploadFile(ctx context.Context, file *os.File, fileName string, stat os.FileInfo, uploadID *string, start checkpoint) (*UploadedFile, error) {
 
 	// List user's files already in inbox to avoid accidental overwrites
-	filesList, err := s.fileManager.ListFiles(true)
+	filesList, err := s.inboxListing(ctx)
 	if err != nil {
-		fmt.Println("Could not read previous uploaded files, this is ok if it's your first upload")
-		//		return err
+		s.report("Could not read previous uploaded files, this is ok if it's your first upload")
+		//		return nil, err
 	} else {
 		for _, uploadedFile := range *filesList {
-			if fileName == filepath.Base(uploadedFile.FileName) {
-				return errors.New("File " + file.Name() + " is already uploaded. Please, remove it from the Inbox first: lega-commander files -d " + filepath.Base(uploadedFile.FileName))
+			if isSameFile(uploadedFile.FileName, fileName) {
+				return nil, errors.New("File " + file.Name() + " is already uploaded. Please, remove it from the Inbox first: lega-commander files -d " + uploadedFile.FileName)
 			}
 		}
 	}
 
-	// Make sure the file to be uploaded is a crypt4gh encrypted file
-	if err = isCrypt4GHFile(file); err != nil {
-		return err
+	source, err := s.openSource(file, stat, start.offset)
+	if err != nil {
+		return nil, err
 	}
-
-	totalSize := stat.Size()
-	fmt.Println(aurora.Blue("Uploading file: " + file.Name() + " (" + strconv.FormatInt(totalSize, 10) + " bytes)"))
-	bar := pb.StartNew(100)
-	bar.SetTotal(totalSize)
-	bar.SetCurrent(offset)
-	bar.Start()
+	defer source.close()
+	totalSize := source.size
+	bar := s.startProgressBar(file, totalSize, start.offset)
 	configuration := conf.NewConfiguration()
-	hashFunction := sha256.New()
-	_, err = file.Seek(offset, 0)
+	hashes, err := resumedHashes(file, start)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	buffer := make([]byte, configuration.GetChunkSize()*1024*1024)
-	for i := startChunk; true; i++ {
-		read, err := file.Read(buffer)
-		if err != nil {
-			if err != io.EOF {
-				return err
-			}
-			break
-		}
-		chunk := buffer[:read]
-		hashFunction.Write(chunk)
-		sum := md5.Sum(chunk)
-		params := map[string]string{
-			"chunk": strconv.FormatInt(i, 10),
-			"md5":   hex.EncodeToString(sum[:16])}
-		if i != 1 {
-			params["uploadId"] = *uploadID
-		}
-		response, err := s.client.DoRequest(http.MethodPatch,
+	uploadID, err = sendChunks(ctx, source.reader, uploadID, start, hashes, bar, func(ctx context.Context, c chunk, uploadID string) (string, error) {
+		return s.sendChunk(ctx, fileName, c, uploadID)
+	}, s.recordProgress(file, fileName, stat))
+	if err != nil {
+		return nil, interruptedAt(err, file.Name())
+	}
+	bar.SetCurrent(totalSize)
+	checksum := hex.EncodeToString(hashes.sha256.Sum(nil))
+	s.report("Assembling the uploaded parts of the file together in order to build it! Duration varies based on filesize.")
+	// All the chunks are sent, so the file is assembled even if the upload is being interrupted.
+	ctx = context.WithoutCancel(ctx)
+	response, err := doWithAAIToken(ctx, func(token string) (*http.Response, error) {
+		return s.client.DoRequest(ctx, http.MethodPatch,
 			configuration.GetLocalEGAInstanceURL()+"/stream/"+url.QueryEscape(fileName),
-			bytes.NewReader(chunk),
-			map[string]string{"Proxy-Authorization": "Bearer " + configuration.GetElixirAAIToken()},
-			params,
+			nil,
+			map[string]string{"Proxy-Authorization": "Bearer " + token},
+			map[string]string{"uploadId": *uploadID,
+				"chunk":    "end",
+				"fileSize": strconv.FormatInt(totalSize, 10),
+				"sha256":   checksum},
 			configuration.GetCentralEGAUsername(),
 			configuration.GetCentralEGAPassword())
-		if err != nil {
-			return err
-		}
-		if response.StatusCode != 200 {
-			return errors.New(response.Status)
-		}
-		body, err := ioutil.ReadAll(response.Body)
-		if err != nil {
-			return err
-		}
-		err = response.Body.Close()
-		if err != nil {
-			return err
-		}
-		if uploadID == nil {
-			uploadID = new(string)
-		}
-		*uploadID, err = jsonparser.GetString(body, "id")
-		if err != nil {
-			return err
-		}
-		bar.SetCurrent(int64(read)*(i-startChunk+1) + offset)
+	})
+	if err != nil {
+		return nil, err
 	}
-	bar.SetCurrent(totalSize)
-	checksum := hex.EncodeToString(hashFunction.Sum(nil))
-	fmt.Println("Assembling the uploaded parts of the file together in order to build it! Duration varies based on filesize.")
-	response, err := s.client.DoRequest(http.MethodPatch,
-		configuration.GetLocalEGAInstanceURL()+"/stream/"+url.QueryEscape(fileName),
-		nil,
-		map[string]string{"Proxy-Authorization": "Bearer " + configuration.GetElixirAAIToken()},
-		map[string]string{"uploadId": *uploadID,
-			"chunk":    "end",
-			"fileSize": strconv.FormatInt(totalSize, 10),
-			"sha256":   checksum},
-		configuration.GetCentralEGAUsername(),
-		configuration.GetCentralEGAPassword())
+	if err = requests.CheckResponse(response); err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(response.Body)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if response.StatusCode != 200 {
-		return errors.New(response.Status)
+	err = response.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	confirmed, err := confirmChecksum(body, checksum)
+	if err != nil {
+		return nil, errors.New(file.Name() + ": " + err.Error())
+	}
+	if !confirmed {
+		s.warn("Checksum of " + file.Name() + " is not confirmed by the server")
+	}
+	if err = s.journal.Delete(fileName); err != nil {
+		return nil, err
+	}
+	s.finishProgressBar(bar)
+	uploadedFile := newUploadedFile(file, fileName, totalSize, checksum, hashes.md5, *uploadID)
+	uploadedFile.ChecksumConfirmed = confirmed
+	source.addPlaintextChecksums(uploadedFile)
+	return uploadedFile, nil
+}
+
+func (s defaultStreamer) sendChunk(ctx context.Context, fileName string, c chunk, uploadID string) (string, error) {
+	configuration := conf.NewConfiguration()
+	params := map[string]string{
+		"chunk": strconv.FormatInt(c.number, 10),
+		"md5":   c.md5}
+	if c.number != 1 {
+		params["uploadId"] = uploadID
+	}
+	response, err := doWithAAIToken(ctx, func(token string) (*http.Response, error) {
+		return s.client.DoRequest(ctx, http.MethodPatch,
+			configuration.GetLocalEGAInstanceURL()+"/stream/"+url.QueryEscape(fileName),
+			requests.NewReplayableBody(c.data),
+			map[string]string{"Proxy-Authorization": "Bearer " + token},
+			params,
+			configuration.GetCentralEGAUsername(),
+			configuration.GetCentralEGAPassword())
+	})
+	if err != nil {
+		return "", err
+	}
+	if err = requests.CheckResponse(response); err != nil {
+		return "", err
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", err
 	}
 	err = response.Body.Close()
 	if err != nil {
-		return err
+		return "", err
 	}
-	bar.Finish()
-	return nil
+	return jsonparser.GetString(body, "id")
 }
 
 func isCrypt4GHFile(file *os.File) error {
@@ -269,52 +694,112 @@ func isCrypt4GHFile(file *os.File) error {
 	return err
 }
 
-// Download method downloads file from LocalEGA.
-func (s defaultStreamer) Download(fileName string) error {
+// Download method downloads file from LocalEGA. Once the context is done, the download stops, keeping the partially
+// downloaded file to be resumed.
+func (s defaultStreamer) Download(ctx context.Context, fileName string, options DownloadOptions) error {
+	if options.PrivateKey != nil {
+		if options.Resume {
+			return errors.New("decrypted downloads can not be resumed")
+		}
+		return s.downloadDecrypted(ctx, fileName, *options.PrivateKey)
+	}
+	offset := int64(0)
 	if fileExists(fileName) {
-		return errors.New("File " + fileName + " exists locally, aborting.")
+		if !options.Resume {
+			return errors.New("File " + fileName + " exists locally, aborting.")
+		}
+		stat, err := os.Stat(fileName)
+		if err != nil {
+			return err
+		}
+		offset = stat.Size()
 	}
-	filesList, err := s.fileManager.ListFiles(false)
+	fileSize, err := s.exportedFileSize(ctx, fileName)
 	if err != nil {
 		return err
 	}
-	found := false
-	fileSize := int64(0)
-	for _, exportedFile := range *filesList {
-		if fileName == filepath.Base(exportedFile.FileName) {
-			found = true
-			fileSize = exportedFile.Size
-			break
-		}
+	if offset > fileSize {
+		return errors.New("File " + fileName + " is larger locally than in the outbox, aborting.")
 	}
-	if !found {
-		return errors.New("File " + fileName + " not found in the outbox.")
+	if options.Resume && offset == fileSize {
+		fmt.Println(aurora.Blue("File " + fileName + " is already downloaded."))
+		return nil
 	}
-	file, err := os.Create(fileName)
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 	fmt.Println(aurora.Blue("Downloading file: " + file.Name() + " (" + strconv.FormatInt(fileSize, 10) + " bytes)"))
-	bar := pb.Start64(fileSize)
-	configuration := conf.NewConfiguration()
-	response, err := s.client.DoRequest(http.MethodGet,
-		configuration.GetLocalEGAInstanceURL()+"/stream/"+url.QueryEscape(fileName),
-		nil,
-		map[string]string{"Proxy-Authorization": "Bearer " + configuration.GetElixirAAIToken()},
-		map[string]string{"fileName": fileName},
-		"",
-		"")
+	response, err := s.requestExportedFile(ctx, fileName, offset)
 	if err != nil {
 		return err
 	}
-	if response.StatusCode != 200 {
-		return errors.New(response.Status)
+	if offset != 0 && response.StatusCode == 200 {
+		// The server ignored the range, so the whole file is coming again.
+		fmt.Println(aurora.Yellow("Server does not support resuming, downloading " + fileName + " from the beginning."))
+		err = file.Truncate(0)
+		if err != nil {
+			return err
+		}
+		offset = 0
+	} else if err = requests.CheckResponse(response, http.StatusOK, http.StatusPartialContent); err != nil {
+		return err
 	}
+	bar := pb.Start64(fileSize)
+	bar.SetCurrent(offset)
 	barReader := bar.NewProxyReader(response.Body)
 	defer barReader.Close()
 	_, err = io.Copy(file, barReader)
-	return err
+	if err != nil && ctx.Err() != nil {
+		return errors.New("Download of " + fileName + " is interrupted at " + strconv.FormatInt(bar.Current(), 10) +
+			" bytes, use --resume to continue.")
+	}
+	if err != nil {
+		return err
+	}
+	bar.Finish()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() != fileSize {
+		return errors.New("File " + fileName + " is incomplete: " + strconv.FormatInt(stat.Size(), 10) + " of " +
+			strconv.FormatInt(fileSize, 10) + " bytes downloaded, use --resume to continue.")
+	}
+	return nil
+}
+
+// exportedFileSize looks the file up in the outbox and returns its size.
+func (s defaultStreamer) exportedFileSize(ctx context.Context, fileName string) (int64, error) {
+	filesList, err := s.fileManager.ListFiles(ctx, false)
+	if err != nil {
+		return 0, err
+	}
+	for _, exportedFile := range *filesList {
+		if fileName == filepath.Base(exportedFile.FileName) {
+			return exportedFile.Size, nil
+		}
+	}
+	return 0, errors.New("File " + fileName + " not found in the outbox.")
+}
+
+// requestExportedFile requests the file from the outbox, starting from the offset.
+func (s defaultStreamer) requestExportedFile(ctx context.Context, fileName string, offset int64) (*http.Response, error) {
+	configuration := conf.NewConfiguration()
+	return doWithAAIToken(ctx, func(token string) (*http.Response, error) {
+		headers := map[string]string{"Proxy-Authorization": "Bearer " + token}
+		if offset != 0 {
+			headers["Range"] = "bytes=" + strconv.FormatInt(offset, 10) + "-"
+		}
+		return s.client.DoRequest(ctx, http.MethodGet,
+			configuration.GetLocalEGAInstanceURL()+"/stream/"+url.QueryEscape(fileName),
+			nil,
+			headers,
+			map[string]string{"fileName": fileName},
+			"",
+			"")
+	})
 }
 
 func fileExists(fileName string) bool {
@@ -325,153 +810,178 @@ func fileExists(fileName string) bool {
 	return !info.IsDir()
 }
 
-func extractClaims(response *http.Response) (string, jwt.MapClaims, error) {
-	if response.StatusCode != 200 {
-		return "", nil, errors.New(response.Status)
+// extractToken reads the TSD token from the response of the proxy.
+func extractToken(response *http.Response) (string, error) {
+	if err := requests.CheckResponse(response); err != nil {
+		return "", err
 	}
 	body, err := ioutil.ReadAll(response.Body)
 	if err != nil {
-		return "", nil, err
+		return "", err
 	}
 
 	var respjson ResponseJson
 	err = json.Unmarshal(body, &respjson)
 	if err != nil {
-		return "", nil, err
+		return "", err
 	}
 	err = response.Body.Close()
 	if err != nil {
-		return "", nil, err
+		return "", err
 	}
-
-	claims := jwt.MapClaims{}
-	jwt.ParseWithClaims(respjson.Token, claims, func(token *jwt.Token) (interface{}, error) {
-		return []byte(""), nil
-	})
-	return respjson.Token, claims, nil
+	return respjson.Token, nil
 }
 
-func (s defaultStreamer) getTSDtoken(c conf.Configuration) (string, jwt.MapClaims, error) {
-	fmt.Println("asking for tsd connection details from proxy service...")
-	// var response *http.Response
-	// var err error
-	response, err := s.client.DoRequest(http.MethodGet,
-		c.GetLocalEGAInstanceURL()+"/gettoken",
-		nil,
-		map[string]string{"Proxy-Authorization": "Bearer " + c.GetElixirAAIToken()},
-		nil,
-		c.GetCentralEGAUsername(),
-		c.GetCentralEGAPassword())
+func (s defaultStreamer) getTSDtoken(ctx context.Context, c conf.Configuration) (string, jwt.MapClaims, error) {
+	response, err := doWithAAIToken(ctx, func(token string) (*http.Response, error) {
+		return s.client.DoRequest(ctx, http.MethodGet,
+			c.GetLocalEGAInstanceURL()+"/gettoken",
+			nil,
+			map[string]string{"Proxy-Authorization": "Bearer " + token},
+			nil,
+			c.GetCentralEGAUsername(),
+			c.GetCentralEGAPassword())
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	token, err := extractToken(response)
+	if err != nil {
+		return "", nil, err
+	}
+	claims, err := newTokenVerifier(s.client, c).verify(ctx, token)
 	if err != nil {
 		return "", nil, err
 	}
-	return extractClaims(response)
+	return token, claims, nil
 }
 
-func (s *defaultStreamer) uploadFileWithoutProxy(file *os.File, stat os.FileInfo, uploadID *string, offset, startChunk int64) error {
-	fileName := filepath.Base(file.Name())
-	filesList, err := s.fileManager.ListFiles(true)
+func (s *defaultStreamer) uploadFileWithoutProxy(ctx context.Context, file *os.File, fileName string, stat os.FileInfo, uploadID *string, start checkpoint) (*UploadedFile, error) {
+	filesList, err := s.inboxListing(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	for _, uploadedFile := range *filesList {
-		if fileName == filepath.Base(uploadedFile.FileName) {
-			return errors.New("File " + file.Name() + " is already uploaded. Please, remove it from the Inbox first: lega-commander files -d " + filepath.Base(uploadedFile.FileName))
+		if isSameFile(uploadedFile.FileName, fileName) {
+			return nil, errors.New("File " + file.Name() + " is already uploaded. Please, remove it from the Inbox first: lega-commander files -d " + uploadedFile.FileName)
 		}
 	}
+	user, err := s.tsdToken.user(ctx)
+	if err != nil {
+		return nil, err
+	}
 	configuration := conf.NewConfiguration()
 	streamurl := configuration.ConcatenateURLPartsToString(
 		[]string{
-			configuration.GetTSDURL(), s.claims["user"].(string), "files", url.QueryEscape(fileName),
+			configuration.GetTSDURL(), user, "files", url.QueryEscape(fileName),
 		},
 	)
-	if err = isCrypt4GHFile(file); err != nil {
-		return err
+	source, err := s.openSource(file, stat, start.offset)
+	if err != nil {
+		return nil, err
 	}
-	totalSize := stat.Size()
-	fmt.Println(aurora.Blue("Uploading file: " + file.Name() + " (" + strconv.FormatInt(totalSize, 10) + " bytes)"))
-	bar := pb.StartNew(100)
-	bar.SetTotal(totalSize)
-	bar.SetCurrent(offset)
-	bar.Start()
-
-	_, err = file.Seek(offset, 0)
+	defer source.close()
+	totalSize := source.size
+	bar := s.startProgressBar(file, totalSize, start.offset)
+	hashes, err := resumedHashes(file, start)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	buffer := make([]byte, configuration.GetChunkSize()*1024*1024)
-	for i := startChunk; true; i++ {
-		read, err := file.Read(buffer)
-		if err != nil {
-			if err != io.EOF {
-				return err
-			}
-			break
-		}
-		chunk := buffer[:read]
-		if err != nil {
-			return err
-		}
-		var response *http.Response
-		if i != 1 {
-			response, err = s.client.DoRequest(http.MethodPatch,
-				streamurl,
-				bytes.NewReader(chunk),
-				map[string]string{"Authorization": "Bearer " + s.tsd_token},
-				map[string]string{"id": *uploadID, "chunk": strconv.FormatInt(i, 10)},
-				"",
-				"")
-		} else {
-			response, err = s.client.DoRequest(http.MethodPatch,
-				streamurl,
-				bytes.NewReader(chunk),
-				map[string]string{"Authorization": "Bearer " + s.tsd_token},
-				map[string]string{"chunk": "1"},
-				"",
-				"")
-		}
-		if err != nil {
-			return err
-		}
-		if !(response.StatusCode == 200 || response.StatusCode == 201) {
-			return errors.New(response.Status)
-		}
-		body, err := ioutil.ReadAll(response.Body)
-		if err != nil {
-			return err
-		}
-		err = response.Body.Close()
-		if err != nil {
-			return err
-		}
-		if uploadID == nil {
-			uploadID = new(string)
-		}
-		*uploadID, err = jsonparser.GetString(body, "id")
-		if err != nil {
-			return err
-		}
-		bar.SetCurrent(int64(read)*(i-startChunk+1) + offset)
+	uploadID, err = sendChunks(ctx, source.reader, uploadID, start, hashes, bar, func(ctx context.Context, c chunk, uploadID string) (string, error) {
+		return s.sendChunkWithoutProxy(ctx, streamurl, c, uploadID)
+	}, s.recordProgress(file, fileName, stat))
+	if err != nil {
+		return nil, interruptedAt(err, file.Name())
 	}
 	bar.SetCurrent(totalSize)
-	fmt.Println("assembling different parts of file together in order to make it! Duration varies based on filesize.")
-	response, err := s.client.DoRequest(http.MethodPatch,
-		streamurl,
-		nil,
-		map[string]string{"Authorization": "Bearer " + s.tsd_token},
-		map[string]string{"id": *uploadID, "chunk": "end"},
-		"",
-		"")
+	checksum := hex.EncodeToString(hashes.sha256.Sum(nil))
+	s.report("assembling different parts of file together in order to make it! Duration varies based on filesize.")
+	ctx = context.WithoutCancel(ctx)
+	response, err := s.doWithTSDToken(ctx, func(token string) (*http.Response, error) {
+		return s.client.DoRequest(ctx, http.MethodPatch,
+			streamurl,
+			nil,
+			map[string]string{"Authorization": "Bearer " + token},
+			map[string]string{"id": *uploadID,
+				"chunk":    "end",
+				"fileSize": strconv.FormatInt(totalSize, 10),
+				"sha256":   checksum},
+			"",
+			"")
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if !(response.StatusCode == 200 || response.StatusCode == 201) {
-		return errors.New(response.Status)
+	if err = requests.CheckResponse(response, http.StatusOK, http.StatusCreated); err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
 	}
 	err = response.Body.Close()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	bar.Finish()
-	return nil
+	confirmed, err := confirmChecksum(body, checksum)
+	if err != nil {
+		return nil, errors.New(file.Name() + ": " + err.Error())
+	}
+	if !confirmed {
+		s.warn("Checksum of " + file.Name() + " is not confirmed by the server")
+	}
+	if err = s.journal.Delete(fileName); err != nil {
+		return nil, err
+	}
+	s.finishProgressBar(bar)
+	uploadedFile := newUploadedFile(file, fileName, totalSize, checksum, hashes.md5, *uploadID)
+	uploadedFile.ChecksumConfirmed = confirmed
+	source.addPlaintextChecksums(uploadedFile)
+	return uploadedFile, nil
+}
+
+func (s *defaultStreamer) sendChunkWithoutProxy(ctx context.Context, streamurl string, c chunk, uploadID string) (string, error) {
+	params := map[string]string{
+		"chunk": strconv.FormatInt(c.number, 10),
+		"md5":   c.md5}
+	if c.number != 1 {
+		params["id"] = uploadID
+	}
+	response, err := s.doWithTSDToken(ctx, func(token string) (*http.Response, error) {
+		return s.client.DoRequest(ctx, http.MethodPatch,
+			streamurl,
+			requests.NewReplayableBody(c.data),
+			map[string]string{"Authorization": "Bearer " + token},
+			params,
+			"",
+			"")
+	})
+	if err != nil {
+		return "", err
+	}
+	if err = requests.CheckResponse(response, http.StatusOK, http.StatusCreated); err != nil {
+		return "", err
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", err
+	}
+	err = response.Body.Close()
+	if err != nil {
+		return "", err
+	}
+	return jsonparser.GetString(body, "id")
+}
+
+// confirmChecksum compares the checksum the server reports for the assembled file to the local one. It tells whether
+// the checksum is confirmed, as a server that does not report it can not confirm it either.
+func confirmChecksum(body []byte, checksum string) (bool, error) {
+	confirmedChecksum, err := jsonparser.GetString(body, "sha256")
+	if err != nil {
+		return false, nil
+	}
+	if !strings.EqualFold(confirmedChecksum, checksum) {
+		return false, errors.New("checksum of the assembled file is " + confirmedChecksum + " instead of " + checksum)
+	}
+	return true, nil
 }
@@ -1,20 +1,46 @@
 package streaming
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/chzyer/test"
+	"github.com/elixir-oslo/lega-commander/conf"
 	"github.com/elixir-oslo/lega-commander/files"
 	"github.com/elixir-oslo/lega-commander/requests"
 	"github.com/elixir-oslo/lega-commander/resuming"
+	"github.com/golang-jwt/jwt"
 	aurora "github.com/logrusorgru/aurora/v3"
+	"github.com/neicnordic/crypt4gh/keys"
+	crypt4gh "github.com/neicnordic/crypt4gh/streaming"
 )
 
 var uploader Streamer
@@ -35,6 +61,11 @@ func setup() {
 	_ = os.Setenv("CENTRAL_EGA_PASSWORD", "pass")
 	_ = os.Setenv("LOCAL_EGA_INSTANCE_URL", "http://localhost/")
 	_ = os.Setenv("ELIXIR_AAI_TOKEN", "token")
+	journal, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		log.Fatal(aurora.Red(err))
+	}
+	_ = os.Setenv("LEGA_COMMANDER_RESUME_JOURNAL", journal)
 	var client requests.Client = mockClient{}
 	filesManager, err := files.NewFileManager(&client)
 	if err != nil {
@@ -44,7 +75,7 @@ func setup() {
 	if err != nil {
 		log.Fatal(aurora.Red(err))
 	}
-	uploader, err = NewStreamer(&client, &filesManager, &resumablesManager, false)
+	uploader, err = NewStreamer(context.Background(), &client, &filesManager, &resumablesManager, false)
 	if err != nil {
 		log.Fatal(aurora.Red(err))
 	}
@@ -62,7 +93,7 @@ func setup() {
 type mockClient struct {
 }
 
-func (mockClient) DoRequest(method, url string, _ io.Reader, headers, params map[string]string, _, _ string) (*http.Response, error) {
+func (mockClient) DoRequest(ctx context.Context, method, url string, _ io.Reader, headers, params map[string]string, _, _ string) (*http.Response, error) {
 	var response http.Response
 	if !strings.HasPrefix(headers["Proxy-Authorization"], "Bearer ") {
 		body := ioutil.NopCloser(strings.NewReader(""))
@@ -74,7 +105,7 @@ func (mockClient) DoRequest(method, url string, _ io.Reader, headers, params map
 		if params["inbox"] == "" || params["inbox"] == "true" {
 			body = ioutil.NopCloser(strings.NewReader(`{"files": [{"fileName": "test.enc", "size": 100, "modifiedDate": "2010"}]}`))
 		} else {
-			body = ioutil.NopCloser(strings.NewReader(`{"files": [{"fileName": "test2.enc", "size": 100, "modifiedDate": "2010"}]}`))
+			body = ioutil.NopCloser(strings.NewReader(`{"files": [{"fileName": "test2.enc", "size": 4, "modifiedDate": "2010"}]}`))
 		}
 		response := http.Response{StatusCode: 200, Body: body}
 		return &response, nil
@@ -114,6 +145,12 @@ func (mockClient) DoRequest(method, url string, _ io.Reader, headers, params map
 			return &response, nil
 		}
 		if method == http.MethodGet {
+			if offset, ok := headers["Range"]; ok {
+				start, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(offset, "bytes="), "-"))
+				body := ioutil.NopCloser(strings.NewReader("test"[start:]))
+				response = http.Response{StatusCode: 206, Body: body}
+				return &response, nil
+			}
 			body := ioutil.NopCloser(strings.NewReader("test"))
 			response = http.Response{StatusCode: 200, Body: body}
 			return &response, nil
@@ -123,35 +160,1257 @@ func (mockClient) DoRequest(method, url string, _ io.Reader, headers, params map
 }
 
 func TestUploadedFileExists(t *testing.T) {
-	err := uploader.Upload(existingFile.Name(), false, false)
+	err := uploader.Upload(context.Background(), existingFile.Name(), UploadOptions{})
 	if err == nil {
 		t.Error()
 	}
 }
 
 func TestUploadFile(t *testing.T) {
-	err := uploader.Upload(file.Name(), false, false)
+	err := uploader.Upload(context.Background(), file.Name(), UploadOptions{})
 	if err != nil {
 		t.Error(err)
 	}
 }
 
+func TestUploadFileManifest(t *testing.T) {
+	manifest := filepath.Join(t.TempDir(), "manifest")
+	err := uploader.Upload(context.Background(), file.Name(), UploadOptions{Manifest: manifest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(manifest + ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var uploadedFiles []UploadedFile
+	err = json.Unmarshal(content, &uploadedFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uploadedFiles) != 1 || uploadedFiles[0].FileName != "sample.txt.enc" || uploadedFiles[0].Size != 65688 ||
+		uploadedFiles[0].SHA256 != "91e93335245604993d0c2599fa22efc2b607301bf1a9b2426a6489adf6bf5af6" ||
+		uploadedFiles[0].MD5 != "da385d93ae510bc91c9c8af7e670ac6f" || uploadedFiles[0].UploadID != "123" ||
+		uploadedFiles[0].ChecksumConfirmed {
+		t.Error(string(content))
+	}
+	content, err = ioutil.ReadFile(manifest + ".tsv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[1], "sample.txt.enc\t"+file.Name()+"\t65688\t91e93335") {
+		t.Error(string(content))
+	}
+}
+
+// chunkRecordingClient records the uploaded chunks, checking they are sent in order, and fails the upload of the
+// chunk failChunk, if set.
+type chunkRecordingClient struct {
+	mockClient
+	mutex     sync.Mutex
+	chunks    map[string][]byte
+	last      int
+	failChunk string
+	checksum  string
+	fileSize  string
+	url       string
+	err       error
+}
+
+func (c *chunkRecordingClient) DoRequest(ctx context.Context, method, url string, body io.Reader, headers, params map[string]string, username, password string) (*http.Response, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if strings.HasSuffix(url, "/files") && c.fileSize != "" {
+		listing := fmt.Sprintf(`{"files": [{"fileName": "big.enc", "size": %v, "checksum": "%v"}]}`, c.fileSize, c.checksum)
+		response := http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(listing))}
+		return &response, nil
+	}
+	if !strings.Contains(url, "/stream") || method != http.MethodPatch {
+		return c.mockClient.DoRequest(ctx, method, url, body, headers, params, username, password)
+	}
+	chunk := params["chunk"]
+	if chunk == "end" {
+		c.chunks["end"] = nil
+		c.url = url
+		c.checksum = params["sha256"]
+		c.fileSize = params["fileSize"]
+	} else {
+		if _, ok := c.chunks["end"]; ok {
+			c.err = fmt.Errorf("chunk %v sent after the end of the upload", chunk)
+		}
+		if chunk != "1" && params["uploadId"] != "123" {
+			c.err = fmt.Errorf("chunk %v sent without upload ID", chunk)
+		}
+		if number, _ := strconv.Atoi(chunk); number != 1 && number != c.last+1 {
+			c.err = fmt.Errorf("chunk %v sent after chunk %v", chunk, c.last)
+		}
+		if chunk == c.failChunk {
+			response := http.Response{StatusCode: 400, Body: ioutil.NopCloser(strings.NewReader(`{"message": "bad chunk"}`))}
+			return &response, nil
+		}
+		c.last, _ = strconv.Atoi(chunk)
+		data, err := ioutil.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		sum := md5.Sum(data)
+		if params["md5"] != hex.EncodeToString(sum[:]) {
+			c.err = fmt.Errorf("chunk %v has wrong checksum", chunk)
+		}
+		c.chunks[chunk] = data
+	}
+	response := http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(`{"id":"123"}`))}
+	return &response, nil
+}
+
+func TestUploadFileInParallel(t *testing.T) {
+	_ = os.Setenv("LEGA_COMMANDER_CHUNK_SIZE", "1")
+	_ = os.Setenv("LEGA_COMMANDER_READ_AHEAD_CHUNKS", "3")
+	defer os.Unsetenv("LEGA_COMMANDER_CHUNK_SIZE")
+	defer os.Unsetenv("LEGA_COMMANDER_READ_AHEAD_CHUNKS")
+	content, err := ioutil.ReadFile(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	content = append(content, bytes.Repeat([]byte("lega"), 1024*1024)...)
+	bigFile := t.TempDir() + "/big.enc"
+	err = ioutil.WriteFile(bigFile, content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &chunkRecordingClient{chunks: map[string][]byte{}}
+	var requestsClient requests.Client = client
+	streamer, err := NewStreamer(context.Background(), &requestsClient, nil, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = streamer.Upload(context.Background(), bigFile, UploadOptions{Verify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.err != nil {
+		t.Error(client.err)
+	}
+	var uploaded []byte
+	for i := 1; i <= 5; i++ {
+		uploaded = append(uploaded, client.chunks[strconv.Itoa(i)]...)
+	}
+	if len(client.chunks) != 6 || !bytes.Equal(uploaded, content) {
+		t.Error("uploaded chunks do not match the file")
+	}
+	sum := sha256.Sum256(content)
+	if client.checksum != hex.EncodeToString(sum[:]) || client.fileSize != strconv.Itoa(len(content)) {
+		t.Error("wrong checksum or size sent at the end of the upload")
+	}
+}
+
+func TestUploadFileFailedChunk(t *testing.T) {
+	t.Setenv("LEGA_COMMANDER_CHUNK_SIZE", "1")
+	t.Setenv("LEGA_COMMANDER_READ_AHEAD_CHUNKS", "3")
+	t.Setenv("LEGA_COMMANDER_RESUME_JOURNAL", t.TempDir())
+	content, err := ioutil.ReadFile(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	content = append(content, bytes.Repeat([]byte("lega"), 1024*1024)...)
+	bigFile := t.TempDir() + "/big.enc"
+	if err = ioutil.WriteFile(bigFile, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	client := &chunkRecordingClient{chunks: map[string][]byte{}, failChunk: "2"}
+	var requestsClient requests.Client = client
+	streamer, err := NewStreamer(context.Background(), &requestsClient, nil, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = streamer.Upload(context.Background(), bigFile, UploadOptions{}); err == nil {
+		t.Error("upload with the failed chunk succeeded")
+	}
+	if len(client.chunks) != 1 || client.err != nil {
+		t.Error("chunks sent after the failed one", client.err)
+	}
+	entry, err := resuming.NewJournal(conf.NewConfiguration().GetResumeJournalDirectory()).Load("big.enc")
+	if err != nil || entry == nil || entry.Chunk != 1 || entry.Offset != 1024*1024 {
+		t.Error(entry, err)
+	}
+}
+
+// interruptingClient cancels the upload once the chunk is sent, checking the chunks are not sent with the cancelled
+// context, and lists the resumable uploads.
+type interruptingClient struct {
+	*chunkRecordingClient
+	chunk      string
+	cancel     context.CancelFunc
+	resumables string
+}
+
+func (c interruptingClient) DoRequest(ctx context.Context, method, url string, body io.Reader, headers, params map[string]string, username, password string) (*http.Response, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if strings.HasSuffix(url, "/resumables") {
+		response := http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(c.resumables))}
+		return &response, nil
+	}
+	response, err := c.chunkRecordingClient.DoRequest(ctx, method, url, body, headers, params, username, password)
+	if c.cancel != nil && params["chunk"] == c.chunk {
+		c.cancel()
+	}
+	return response, err
+}
+
+// interruptUpload uploads the big file in chunks of 1 MB, one at a time, interrupting the upload after the second one.
+func interruptUpload(t *testing.T) (string, []byte, *chunkRecordingClient, error) {
+	t.Setenv("LEGA_COMMANDER_CHUNK_SIZE", "1")
+	t.Setenv("LEGA_COMMANDER_READ_AHEAD_CHUNKS", "1")
+	t.Setenv("LEGA_COMMANDER_RESUME_JOURNAL", t.TempDir())
+	content, err := ioutil.ReadFile(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	content = append(content, bytes.Repeat([]byte("lega"), 1024*1024)...)
+	bigFile := t.TempDir() + "/big.enc"
+	err = ioutil.WriteFile(bigFile, content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := interruptingClient{&chunkRecordingClient{chunks: map[string][]byte{}}, "2", cancel, ""}
+	var requestsClient requests.Client = client
+	streamer, err := NewStreamer(ctx, &requestsClient, nil, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bigFile, content, client.chunkRecordingClient, streamer.Upload(ctx, bigFile, UploadOptions{})
+}
+
+// resumeUpload resumes the upload of the file, with the server listing the resumable upload.
+func resumeUpload(t *testing.T, bigFile string, client *chunkRecordingClient, resumables string) error {
+	var requestsClient requests.Client = interruptingClient{client, "", nil, resumables}
+	streamer, err := NewStreamer(context.Background(), &requestsClient, nil, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return streamer.Upload(context.Background(), bigFile, UploadOptions{Resume: true})
+}
+
+const interruptedResumables = `{"resumables": [{"id": "123", "fileName": "big.enc", "nextOffset": 2097152, "maxChunk": 2}]}`
+
+func TestUploadFileInterrupted(t *testing.T) {
+	bigFile, _, client, err := interruptUpload(t)
+	var interrupted *InterruptedUploadError
+	if !errors.As(err, &interrupted) || !errors.Is(err, context.Canceled) {
+		t.Fatal(err)
+	}
+	if interrupted.UploadID != "123" || interrupted.Offset != 2*1024*1024 || interrupted.Chunk != 3 || interrupted.Path != bigFile {
+		t.Error(interrupted)
+	}
+	if len(client.chunks) != 2 || client.err != nil {
+		t.Error("chunks sent after the interruption", client.err)
+	}
+	entry, err := resuming.NewJournal(conf.NewConfiguration().GetResumeJournalDirectory()).Load("big.enc")
+	if err != nil || entry == nil {
+		t.Fatal(entry, err)
+	}
+	if entry.UploadID != "123" || entry.Chunk != 2 || entry.Offset != 2*1024*1024 || entry.SHA256State == nil || entry.MD5State == nil {
+		t.Error(entry)
+	}
+}
+
+func TestUploadFileResumed(t *testing.T) {
+	bigFile, content, client, _ := interruptUpload(t)
+	if err := resumeUpload(t, bigFile, client, interruptedResumables); err != nil {
+		t.Fatal(err)
+	}
+	var uploaded []byte
+	for i := 1; i <= 5; i++ {
+		uploaded = append(uploaded, client.chunks[strconv.Itoa(i)]...)
+	}
+	if len(client.chunks) != 6 || !bytes.Equal(uploaded, content) || client.err != nil {
+		t.Error("uploaded chunks do not match the file", client.err)
+	}
+	sum := sha256.Sum256(content)
+	if client.checksum != hex.EncodeToString(sum[:]) || client.fileSize != strconv.Itoa(len(content)) {
+		t.Error("wrong checksum or size sent at the end of the upload")
+	}
+	entry, err := resuming.NewJournal(conf.NewConfiguration().GetResumeJournalDirectory()).Load("big.enc")
+	if err != nil || entry != nil {
+		t.Error("journal entry is left after the upload", entry, err)
+	}
+}
+
+func TestUploadFileNothingToResume(t *testing.T) {
+	bigFile, _, client, _ := interruptUpload(t)
+	err := resumeUpload(t, bigFile, client, `{"resumables": []}`)
+	if err == nil || !strings.Contains(err.Error(), "not resumable anymore") {
+		t.Error(err)
+	}
+	err = resumeUpload(t, bigFile, client, `{"resumables": []}`)
+	var nothingToResume *NothingToResumeError
+	if !errors.As(err, &nothingToResume) || nothingToResume.FileName != "big.enc" {
+		t.Error(err)
+	}
+}
+
+func TestUploadFileChangedSinceInterrupted(t *testing.T) {
+	bigFile, _, client, _ := interruptUpload(t)
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(bigFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	err := resumeUpload(t, bigFile, client, interruptedResumables)
+	if err == nil || !strings.Contains(err.Error(), "has changed") {
+		t.Error(err)
+	}
+	if len(client.chunks) != 2 {
+		t.Error("chunks of the changed file sent")
+	}
+}
+
+// fakeProxy structure is the proxy assembling the uploaded chunks and checking the checksum of the assembled file,
+// optionally interrupting the upload once the chunk is received.
+type fakeProxy struct {
+	*httptest.Server
+	mutex       sync.Mutex
+	uploads     map[string]*fakeUpload
+	interruptAt string
+	interrupt   context.CancelFunc
+	listings    int
+	// misreported is the name of the file listed with a wrong checksum.
+	misreported string
+	// unconfirmed is the name of the file the checksum of which is not confirmed once the file is assembled.
+	unconfirmed string
+}
+
+type fakeUpload struct {
+	fileName string
+	chunks   map[int][]byte
+	checksum string
+}
+
+func newFakeProxy(t *testing.T) *fakeProxy {
+	proxy := &fakeProxy{uploads: map[string]*fakeUpload{}}
+	proxy.Server = httptest.NewServer(http.HandlerFunc(proxy.handle))
+	t.Cleanup(proxy.Close)
+	t.Setenv("LOCAL_EGA_INSTANCE_URL", proxy.URL)
+	return proxy
+}
+
+func (p *fakeProxy) handle(w http.ResponseWriter, r *http.Request) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	query := r.URL.Query()
+	switch {
+	case r.URL.Path == "/files":
+		p.listings++
+		var listed []string
+		for _, upload := range p.uploads {
+			if upload.checksum != "" {
+				checksum := upload.checksum
+				if upload.fileName == p.misreported {
+					checksum = strings.Repeat("0", len(checksum))
+				}
+				listed = append(listed, fmt.Sprintf(`{"fileName": %q, "size": %v, "checksum": %q}`, upload.fileName, len(upload.assemble()), checksum))
+			}
+		}
+		_, _ = fmt.Fprintf(w, `{"files": [%v]}`, strings.Join(listed, ","))
+	case r.URL.Path == "/resumables":
+		var listed []string
+		for id, upload := range p.uploads {
+			if upload.checksum == "" {
+				listed = append(listed, fmt.Sprintf(`{"id": %q, "fileName": %q, "nextOffset": %v, "maxChunk": %v}`, id, upload.fileName, len(upload.assemble()), len(upload.chunks)))
+			}
+		}
+		_, _ = fmt.Fprintf(w, `{"resumables": [%v]}`, strings.Join(listed, ","))
+	case strings.HasPrefix(r.URL.Path, "/stream/") && r.Method == http.MethodPatch:
+		p.handleChunk(w, r, query)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (p *fakeProxy) handleChunk(w http.ResponseWriter, r *http.Request, query url.Values) {
+	id := query.Get("uploadId")
+	if query.Get("chunk") == "1" {
+		id = strconv.Itoa(len(p.uploads) + 1)
+		p.uploads[id] = &fakeUpload{fileName: strings.TrimPrefix(r.URL.Path, "/stream/"), chunks: map[int][]byte{}}
+	}
+	upload, ok := p.uploads[id]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if query.Get("chunk") == "end" {
+		content := upload.assemble()
+		sum := sha256.Sum256(content)
+		checksum := hex.EncodeToString(sum[:])
+		if query.Get("sha256") != checksum || query.Get("fileSize") != strconv.Itoa(len(content)) {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = fmt.Fprintf(w, `{"message": "checksum or size mismatch"}`)
+			return
+		}
+		upload.checksum = checksum
+		if upload.fileName == p.unconfirmed {
+			_, _ = fmt.Fprintf(w, `{"id": %q}`, id)
+			return
+		}
+		_, _ = fmt.Fprintf(w, `{"id": %q, "sha256": %q}`, id, checksum)
+		return
+	}
+	// Like the real server, the chunks are only appended to the ones received before.
+	number, _ := strconv.Atoi(query.Get("chunk"))
+	if number != len(upload.chunks)+1 {
+		w.WriteHeader(http.StatusConflict)
+		_, _ = fmt.Fprintf(w, `{"message": "chunk %v is out of order"}`, number)
+		return
+	}
+	data, _ := ioutil.ReadAll(r.Body)
+	sum := md5.Sum(data)
+	if query.Get("md5") != hex.EncodeToString(sum[:]) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	upload.chunks[number] = data
+	if query.Get("chunk") == p.interruptAt && p.interrupt != nil {
+		p.interrupt()
+	}
+	_, _ = fmt.Fprintf(w, `{"id": %q}`, id)
+}
+
+// assemble joins the chunks received in order, up to the first missing one.
+func (u *fakeUpload) assemble() []byte {
+	var content []byte
+	for number := 1; u.chunks[number] != nil; number++ {
+		content = append(content, u.chunks[number]...)
+	}
+	return content
+}
+
+// uploadToFakeProxy uploads the file through the fake proxy using the real client, interrupting the upload once the
+// chunk is received, if any.
+func uploadToFakeProxy(proxy *fakeProxy, path, interruptAt string, options UploadOptions) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	proxy.mutex.Lock()
+	proxy.interruptAt, proxy.interrupt = interruptAt, cancel
+	proxy.mutex.Unlock()
+	client := requests.NewClient(proxy.Client())
+	streamer, err := NewStreamer(ctx, &client, nil, nil, false)
+	if err != nil {
+		return err
+	}
+	return streamer.Upload(ctx, path, options)
+}
+
+func TestUploadInterruptedAndResumed(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		readAhead   string
+		keepJournal bool
+	}{
+		{"journal", "1", true},
+		{"journal with chunks read ahead", "3", true},
+		{"no journal", "1", false},
+		{"no journal with chunks read ahead", "3", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("LEGA_COMMANDER_CHUNK_SIZE", "1")
+			t.Setenv("LEGA_COMMANDER_READ_AHEAD_CHUNKS", test.readAhead)
+			t.Setenv("LEGA_COMMANDER_RESUME_JOURNAL", t.TempDir())
+			proxy := newFakeProxy(t)
+			content, err := ioutil.ReadFile(file.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			content = append(content, bytes.Repeat([]byte("lega"), 2*1024*1024)...)
+			path := t.TempDir() + "/big.enc"
+			if err = ioutil.WriteFile(path, content, 0600); err != nil {
+				t.Fatal(err)
+			}
+			manifest := t.TempDir() + "/manifest"
+			err = uploadToFakeProxy(proxy, path, "3", UploadOptions{})
+			var interrupted *InterruptedUploadError
+			if !errors.As(err, &interrupted) {
+				t.Fatal(err)
+			}
+			if !test.keepJournal {
+				if err = os.RemoveAll(os.Getenv("LEGA_COMMANDER_RESUME_JOURNAL")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = uploadToFakeProxy(proxy, path, "", UploadOptions{Resume: true, Verify: true, Manifest: manifest})
+			if err != nil {
+				t.Fatal(err)
+			}
+			upload := proxy.uploads[interrupted.UploadID]
+			if !bytes.Equal(upload.assemble(), content) {
+				t.Error("assembled file does not match the local one")
+			}
+			manifestContent, err := ioutil.ReadFile(manifest + ".json")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var uploadedFiles []UploadedFile
+			if err = json.Unmarshal(manifestContent, &uploadedFiles); err != nil {
+				t.Fatal(err)
+			}
+			sha256Sum, md5Sum := sha256.Sum256(content), md5.Sum(content)
+			if len(uploadedFiles) != 1 || uploadedFiles[0].SHA256 != hex.EncodeToString(sha256Sum[:]) ||
+				uploadedFiles[0].MD5 != hex.EncodeToString(md5Sum[:]) || !uploadedFiles[0].ChecksumConfirmed {
+				t.Error(uploadedFiles)
+			}
+		})
+	}
+}
+
+func TestUploadFolderListsInboxOnce(t *testing.T) {
+	t.Setenv("LEGA_COMMANDER_RESUME_JOURNAL", t.TempDir())
+	proxy := newFakeProxy(t)
+	content, err := ioutil.ReadFile(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	folder := t.TempDir()
+	for i := 0; i < 4; i++ {
+		path := filepath.Join(folder, strconv.Itoa(i)+".enc")
+		if err = ioutil.WriteFile(path, append(content, byte(i)), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = uploadToFakeProxy(proxy, folder, "", UploadOptions{Parallel: 2, Verify: true}); err != nil {
+		t.Fatal(err)
+	}
+	if len(proxy.uploads) != 4 || proxy.listings != 2 {
+		t.Error(len(proxy.uploads), proxy.listings)
+	}
+}
+
+func TestUploadFolderWarningsPrinted(t *testing.T) {
+	t.Setenv("LEGA_COMMANDER_RESUME_JOURNAL", t.TempDir())
+	proxy := newFakeProxy(t)
+	proxy.unconfirmed = "1.enc"
+	content, err := ioutil.ReadFile(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	folder := t.TempDir()
+	for i := 0; i < 3; i++ {
+		path := filepath.Join(folder, strconv.Itoa(i)+".enc")
+		if err = ioutil.WriteFile(path, append(content, byte(i)), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	output := captureStdout(t, func() {
+		err = uploadToFakeProxy(proxy, folder, "", UploadOptions{Parallel: 3})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(output, filepath.Join(folder, "1.enc")+" is not confirmed by the server") {
+		t.Error("warning of the parallel upload is not printed:", output)
+	}
+}
+
+// captureStdout returns what the function prints to the standard output.
+func captureStdout(t *testing.T, f func()) string {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+	f()
+	os.Stdout = stdout
+	_ = writer.Close()
+	output, _ := ioutil.ReadAll(reader)
+	return string(output)
+}
+
+func TestUploadManifestWithoutUnverifiedFiles(t *testing.T) {
+	t.Setenv("LEGA_COMMANDER_RESUME_JOURNAL", t.TempDir())
+	proxy := newFakeProxy(t)
+	proxy.misreported = "1.enc"
+	content, err := ioutil.ReadFile(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	folder := t.TempDir()
+	for i := 0; i < 3; i++ {
+		path := filepath.Join(folder, strconv.Itoa(i)+".enc")
+		if err = ioutil.WriteFile(path, append(content, byte(i)), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manifestFileNames := func(manifest string) []string {
+		content, err := ioutil.ReadFile(manifest + ".json")
+		if os.IsNotExist(err) {
+			return nil
+		}
+		var uploadedFiles []UploadedFile
+		if err = json.Unmarshal(content, &uploadedFiles); err != nil {
+			t.Fatal(err)
+		}
+		fileNames := make([]string, 0, len(uploadedFiles))
+		for _, uploadedFile := range uploadedFiles {
+			fileNames = append(fileNames, uploadedFile.FileName)
+		}
+		sort.Strings(fileNames)
+		return fileNames
+	}
+	manifest := filepath.Join(t.TempDir(), "folder")
+	err = uploadToFakeProxy(proxy, folder, "", UploadOptions{Parallel: 2, Verify: true, Manifest: manifest})
+	var failures *UploadFailuresError
+	if !errors.As(err, &failures) || len(failures.Failures) != 1 || failures.Failures[0].Path != filepath.Join(folder, "1.enc") {
+		t.Fatal(err)
+	}
+	if fileNames := manifestFileNames(manifest); strings.Join(fileNames, ",") != "0.enc,2.enc" {
+		t.Error(fileNames)
+	}
+	proxy.misreported = "3.enc"
+	path := filepath.Join(t.TempDir(), "3.enc")
+	if err = ioutil.WriteFile(path, append(content, 3), 0600); err != nil {
+		t.Fatal(err)
+	}
+	manifest = filepath.Join(t.TempDir(), "file")
+	var verificationError *VerificationError
+	err = uploadToFakeProxy(proxy, path, "", UploadOptions{Verify: true, Manifest: manifest})
+	if !errors.As(err, &verificationError) {
+		t.Fatal(err)
+	}
+	if fileNames := manifestFileNames(manifest); len(fileNames) != 0 {
+		t.Error(fileNames)
+	}
+}
+
+func TestResumeAll(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		keepJournal bool
+	}{
+		{"journal", true},
+		{"no journal", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("LEGA_COMMANDER_CHUNK_SIZE", "1")
+			t.Setenv("LEGA_COMMANDER_RESUME_JOURNAL", t.TempDir())
+			proxy := newFakeProxy(t)
+			prefix, err := ioutil.ReadFile(file.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			first, second := t.TempDir(), t.TempDir()
+			if err = os.Mkdir(second+"/sub", 0700); err != nil {
+				t.Fatal(err)
+			}
+			contents := map[string][]byte{}
+			for i, path := range []string{first + "/one.enc", second + "/sub/two.enc", first + "/gone.enc"} {
+				content := append(append([]byte{}, prefix...), bytes.Repeat([]byte{byte('a' + i)}, 3*1024*1024)...)
+				if err = ioutil.WriteFile(path, content, 0600); err != nil {
+					t.Fatal(err)
+				}
+				var interrupted *InterruptedUploadError
+				if err = uploadToFakeProxy(proxy, path, "2", UploadOptions{}); !errors.As(err, &interrupted) {
+					t.Fatal(err)
+				}
+				contents[interrupted.UploadID] = content
+			}
+			if err = os.Remove(first + "/gone.enc"); err != nil {
+				t.Fatal(err)
+			}
+			if !test.keepJournal {
+				if err = os.RemoveAll(os.Getenv("LEGA_COMMANDER_RESUME_JOURNAL")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			client := requests.NewClient(proxy.Client())
+			streamer, err := NewStreamer(context.Background(), &client, nil, nil, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = streamer.ResumeAll(context.Background(), []string{first, second}, UploadOptions{Parallel: 2, Verify: true})
+			var failures *UploadFailuresError
+			if !errors.As(err, &failures) {
+				t.Fatal(err)
+			}
+			if failures.Total != 3 || len(failures.Failures) != 1 || failures.Failures[0].Path != "gone.enc" {
+				t.Error(err)
+			}
+			for id, upload := range proxy.uploads {
+				if upload.fileName == "gone.enc" {
+					if upload.checksum != "" {
+						t.Error("upload without the local file finished")
+					}
+				} else if upload.checksum == "" || !bytes.Equal(upload.assemble(), contents[id]) {
+					t.Error("upload of " + upload.fileName + " is not resumed")
+				}
+			}
+		})
+	}
+}
+
+func TestResumeAllAmbiguous(t *testing.T) {
+	resumable := resuming.Resumable{ID: "1", Name: "sub/one.enc", Size: 10}
+	localFiles := map[string][]localFile{"one.enc": {
+		{"/first/one.enc", "one.enc", 20},
+		{"/second/sub/one.enc", "sub/one.enc", 20},
+		{"/third/other/one.enc", "other/one.enc", 20},
+		{"/fourth/sub/one.enc", "sub/one.enc", 5},
+	}}
+	path, err := localSource(resumable, nil, localFiles)
+	if err != nil || path != "/second/sub/one.enc" {
+		t.Error(path, err)
+	}
+	resumable.Name = "one.enc"
+	if _, err = localSource(resumable, nil, localFiles); err == nil {
+		t.Error("ambiguous local file is chosen")
+	}
+	resumable.Size = 30
+	if _, err = localSource(resumable, nil, localFiles); err == nil {
+		t.Error("local file shorter than the uploaded part is chosen")
+	}
+}
+
+type tsdClient struct {
+	mockClient
+	params map[string]map[string]string
+}
+
+func (c tsdClient) DoRequest(ctx context.Context, method, url string, body io.Reader, headers, params map[string]string, username, password string) (*http.Response, error) {
+	if strings.HasSuffix(url, "/gettoken") {
+		token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"user": "p969-user"}).SignedString([]byte("key"))
+		body := ioutil.NopCloser(strings.NewReader(`{"statusCode": 200, "token": "` + token + `"}`))
+		return &http.Response{StatusCode: 200, Body: body}, nil
+	}
+	if strings.HasSuffix(url, "/p969-user/files/sample.txt.enc") {
+		if headers["Authorization"] == "" {
+			return &http.Response{StatusCode: 401, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+		}
+		c.params[params["chunk"]] = params
+		response := `{"id": "123"}`
+		if params["chunk"] == "end" {
+			response = `{"id": "123", "sha256": "` + params["sha256"] + `"}`
+		}
+		return &http.Response{StatusCode: 201, Body: ioutil.NopCloser(strings.NewReader(response))}, nil
+	}
+	return c.mockClient.DoRequest(ctx, method, url, body, headers, params, username, password)
+}
+
+func TestUploadFileWithoutProxy(t *testing.T) {
+	client := tsdClient{params: map[string]map[string]string{}}
+	var requestsClient requests.Client = client
+	var streamer Streamer
+	var err error
+	output := captureStdout(t, func() {
+		streamer, err = NewStreamer(context.Background(), &requestsClient, nil, nil, true)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(output, "WARNING: the signature of the TSD token is not checked") {
+		t.Error("unchecked signature is not warned about:", output)
+	}
+	err = streamer.Upload(context.Background(), file.Name(), UploadOptions{Straight: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.params["1"]["md5"] != "da385d93ae510bc91c9c8af7e670ac6f" {
+		t.Error(client.params["1"])
+	}
+	end := client.params["end"]
+	if end["id"] != "123" || end["fileSize"] != "65688" || end["sha256"] != "91e93335245604993d0c2599fa22efc2b607301bf1a9b2426a6489adf6bf5af6" {
+		t.Error(end)
+	}
+}
+
+// expiringTSDClient issues TSD tokens expiring after the lifetime, and rejects the first chunk sent with the first
+// token, as if it expired on the server side.
+type expiringTSDClient struct {
+	tsdClient
+	lifetime time.Duration
+	issued   *[]string
+}
+
+func (c expiringTSDClient) DoRequest(ctx context.Context, method, url string, body io.Reader, headers, params map[string]string, username, password string) (*http.Response, error) {
+	if strings.HasSuffix(url, "/gettoken") {
+		claims := jwt.MapClaims{"user": "p969-user", "exp": time.Now().Add(c.lifetime).Unix(), "jti": len(*c.issued)}
+		token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("key"))
+		*c.issued = append(*c.issued, token)
+		body := ioutil.NopCloser(strings.NewReader(`{"statusCode": 200, "token": "` + token + `"}`))
+		return &http.Response{StatusCode: 200, Body: body}, nil
+	}
+	if headers["Authorization"] == "Bearer "+(*c.issued)[0] && params["chunk"] == "1" {
+		return &http.Response{StatusCode: 401, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	}
+	return c.tsdClient.DoRequest(ctx, method, url, body, headers, params, username, password)
+}
+
+func TestUploadFileWithoutProxyTokenRejected(t *testing.T) {
+	client := expiringTSDClient{tsdClient{params: map[string]map[string]string{}}, time.Hour, &[]string{}}
+	var requestsClient requests.Client = client
+	streamer, err := NewStreamer(context.Background(), &requestsClient, nil, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = streamer.Upload(context.Background(), file.Name(), UploadOptions{Straight: true}); err != nil {
+		t.Fatal(err)
+	}
+	if len(*client.issued) != 2 || client.params["1"] == nil || client.params["end"]["id"] != "123" {
+		t.Error(len(*client.issued), client.params)
+	}
+}
+
+func TestTSDTokenRenewal(t *testing.T) {
+	client := expiringTSDClient{tsdClient{params: map[string]map[string]string{}}, time.Minute, &[]string{}}
+	var requestsClient requests.Client = client
+	streamer, err := NewStreamer(context.Background(), &requestsClient, nil, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tsd := streamer.(defaultStreamer).tsdToken
+	token, err := tsd.get(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*client.issued) != 2 || token != (*client.issued)[1] {
+		t.Error("token about to expire was not renewed")
+	}
+	if claimsExpiry(jwt.MapClaims{"exp": float64(100)}) != time.Unix(100, 0) || !claimsExpiry(jwt.MapClaims{}).IsZero() {
+		t.Error()
+	}
+}
+
+func TestTSDTokenUser(t *testing.T) {
+	expiring := jwt.MapClaims{"user": "p969-user", "exp": float64(time.Now().Unix())}
+	tsd := newTSDToken("first", expiring, func(ctx context.Context) (string, jwt.MapClaims, error) {
+		return "second", jwt.MapClaims{"user": "p969-renewed"}, nil
+	})
+	user, err := tsd.user(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user != "p969-renewed" {
+		t.Error("user was not taken from the renewed token: " + user)
+	}
+	tsd = newTSDToken("token", jwt.MapClaims{}, nil)
+	if _, err := tsd.user(context.Background()); err == nil {
+		t.Error("token without the user claim was accepted")
+	}
+}
+
+// jwksClient serves the JSON Web Key Set.
+type jwksClient struct {
+	mockClient
+	jwks string
+}
+
+func (c jwksClient) DoRequest(ctx context.Context, method, url string, body io.Reader, headers, params map[string]string, username, password string) (*http.Response, error) {
+	if strings.HasSuffix(url, "/jwks.json") {
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(c.jwks))}, nil
+	}
+	return c.mockClient.DoRequest(ctx, method, url, body, headers, params, username, password)
+}
+
+func TestTokenVerifierPinnedKey(t *testing.T) {
+	publicKey, privateKey, _ := ed25519.GenerateKey(nil)
+	der, _ := x509.MarshalPKIXPublicKey(publicKey)
+	keyPath := filepath.Join(t.TempDir(), "tsd.pem")
+	_ = os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644)
+	verifier := tokenVerifier{keyPath: keyPath, audience: "tsd"}
+	sign := func(claims jwt.MapClaims) string {
+		token, _ := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims).SignedString(privateKey)
+		return token
+	}
+	valid := jwt.MapClaims{"user": "p969-user", "aud": "tsd", "exp": time.Now().Add(time.Hour).Unix()}
+	if claims, err := verifier.verify(context.Background(), sign(valid)); err != nil || claims["user"] != "p969-user" {
+		t.Error(claims, err)
+	}
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+	forged, _ := jwt.NewWithClaims(jwt.SigningMethodEdDSA, valid).SignedString(otherKey)
+	hmac, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, valid).SignedString(der)
+	invalid := map[string]string{
+		"forged":     forged,
+		"hmac":       hmac,
+		"expired":    sign(jwt.MapClaims{"user": "p969-user", "aud": "tsd", "exp": time.Now().Add(-time.Hour).Unix()}),
+		"not before": sign(jwt.MapClaims{"user": "p969-user", "aud": "tsd", "nbf": time.Now().Add(time.Hour).Unix()}),
+		"audience":   sign(jwt.MapClaims{"user": "p969-user", "aud": "other"}),
+		"no user":    sign(jwt.MapClaims{"aud": "tsd"}),
+		"non-string": sign(jwt.MapClaims{"user": 969, "aud": "tsd"}),
+	}
+	for name, token := range invalid {
+		if _, err := verifier.verify(context.Background(), token); err == nil {
+			t.Error(name + " token is accepted")
+		}
+	}
+}
+
+func TestTokenVerifierJWKS(t *testing.T) {
+	privateKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	encode := func(value *big.Int) string {
+		return base64.RawURLEncoding.EncodeToString(value.FillBytes(make([]byte, 32)))
+	}
+	jwks := `{"keys": [{"kty": "EC", "kid": "tsd-1", "use": "sig", "crv": "P-256", "x": "` + encode(privateKey.X) +
+		`", "y": "` + encode(privateKey.Y) + `"}, {"kty": "RSA", "kid": "tsd-0", "n": "AQAB", "e": "AQAB"}]}`
+	verifier := tokenVerifier{client: jwksClient{jwks: jwks}, jwksURL: "http://localhost/jwks.json"}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{"user": "p969-user"})
+	token.Header["kid"] = "tsd-1"
+	signed, _ := token.SignedString(privateKey)
+	if _, err := verifier.verify(context.Background(), signed); err != nil {
+		t.Error(err)
+	}
+	token.Header["kid"] = "tsd-0"
+	signed, _ = token.SignedString(privateKey)
+	if _, err := verifier.verify(context.Background(), signed); err == nil {
+		t.Error("token signed with another key is accepted")
+	}
+	delete(token.Header, "kid")
+	signed, _ = token.SignedString(privateKey)
+	if _, err := verifier.verify(context.Background(), signed); err == nil || !strings.Contains(err.Error(), "which of the keys") {
+		t.Error(err)
+	}
+}
+
+func TestConfirmChecksum(t *testing.T) {
+	if confirmed, err := confirmChecksum([]byte(`{"id": "123"}`), "abc"); confirmed || err != nil {
+		t.Error(confirmed, err)
+	}
+	if confirmed, err := confirmChecksum([]byte(`{"sha256": "ABC"}`), "abc"); !confirmed || err != nil {
+		t.Error(confirmed, err)
+	}
+	if _, err := confirmChecksum([]byte(`{"sha256": "abd"}`), "abc"); err == nil {
+		t.Error()
+	}
+}
+
+func TestUploadFileEncrypted(t *testing.T) {
+	publicKey, privateKey, err := keys.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKeyPath := filepath.Join(t.TempDir(), "recipient.pub")
+	publicKeyFile, err := os.Create(publicKeyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = keys.WriteCrypt4GHX25519PublicKey(publicKeyFile, publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = publicKeyFile.Close()
+	client := &chunkRecordingClient{chunks: map[string][]byte{}}
+	var requestsClient requests.Client = client
+	streamer, err := NewStreamer(context.Background(), &requestsClient, nil, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = streamer.Upload(context.Background(), file.Name(), UploadOptions{Encrypt: true, PublicKey: publicKeyPath})
+	if err == nil || !strings.HasSuffix(err.Error(), "already a Crypt4GH file, upload it without --encrypt") {
+		t.Error(err)
+	}
+	manifest := filepath.Join(t.TempDir(), "manifest")
+	err = streamer.Upload(context.Background(), filepath.Join(dir, "sample.txt"), UploadOptions{Encrypt: true, PublicKey: publicKeyPath, Manifest: manifest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.err != nil {
+		t.Error(client.err)
+	}
+	if !strings.HasSuffix(client.url, "/stream/sample.txt.c4gh") || client.fileSize != strconv.Itoa(len(client.chunks["1"])) {
+		t.Error(client.url, client.fileSize)
+	}
+	reader, err := crypt4gh.NewCrypt4GHReader(bytes.NewReader(client.chunks["1"]), privateKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := ioutil.ReadFile(filepath.Join(dir, "sample.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Error("uploaded file does not decrypt to the original one")
+	}
+	content, err := ioutil.ReadFile(manifest + ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(plaintext)
+	if !strings.Contains(string(content), `"plaintextSha256": "`+hex.EncodeToString(sum[:])+`"`) {
+		t.Error(string(content))
+	}
+}
+
+func TestUploadFileRecipientCheck(t *testing.T) {
+	ingestionPublicKey, ingestionPrivateKey, err := keys.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPublicKey, _, err := keys.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, writerPrivateKey, err := keys.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempDir := t.TempDir()
+	writeKey := func(name string, publicKey [32]byte) string {
+		keyFile, err := os.Create(filepath.Join(tempDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer keyFile.Close()
+		if err = keys.WriteCrypt4GHX25519PublicKey(keyFile, publicKey); err != nil {
+			t.Fatal(err)
+		}
+		return keyFile.Name()
+	}
+	encryptFile := func(name string, publicKey [32]byte) string {
+		encrypted, err := os.Create(filepath.Join(tempDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer encrypted.Close()
+		writer, err := crypt4gh.NewCrypt4GHWriter(encrypted, writerPrivateKey, [][32]byte{publicKey}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = writer.Write([]byte("Hello, World!"))
+		_ = writer.Close()
+		return encrypted.Name()
+	}
+	upload := func(path string, options UploadOptions) (*chunkRecordingClient, error) {
+		client := &chunkRecordingClient{chunks: map[string][]byte{}}
+		var requestsClient requests.Client = client
+		streamer, err := NewStreamer(context.Background(), &requestsClient, nil, nil, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client, streamer.Upload(context.Background(), path, options)
+	}
+	_ = os.Setenv("LEGA_COMMANDER_INGESTION_PUBKEY", writeKey("ingestion.pub", ingestionPublicKey))
+	defer os.Unsetenv("LEGA_COMMANDER_INGESTION_PUBKEY")
+	addressed := encryptFile("addressed.c4gh", ingestionPublicKey)
+	misaddressed := encryptFile("misaddressed.c4gh", otherPublicKey)
+	ephemeral, err := os.Create(filepath.Join(tempDir, "ephemeral.c4gh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ephemeralWriter, err := crypt4gh.NewCrypt4GHWriterWithoutPrivateKey(ephemeral, [][32]byte{ingestionPublicKey}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = ephemeralWriter.Write([]byte("Hello, World!"))
+	_ = ephemeralWriter.Close()
+	_ = ephemeral.Close()
+
+	_, err = upload(ephemeral.Name(), UploadOptions{WriterPrivateKeys: [][32]byte{writerPrivateKey}})
+	if err == nil || !strings.HasSuffix(err.Error(), "or --no-recipient-check if it is an ephemeral key") {
+		t.Error("file written with an ephemeral key is not refused:", err)
+	}
+	_, err = upload(ephemeral.Name(), UploadOptions{SkipRecipientCheck: true})
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = upload(addressed, UploadOptions{})
+	if err == nil || !strings.Contains(err.Error(), "use --writer-seckey to give it") {
+		t.Error(err)
+	}
+	_, err = upload(addressed, UploadOptions{WriterPrivateKeys: [][32]byte{writerPrivateKey}})
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = upload(misaddressed, UploadOptions{WriterPrivateKeys: [][32]byte{writerPrivateKey}})
+	if err == nil || !strings.Contains(err.Error(), "not encrypted for the ingestion key") {
+		t.Error(err)
+	}
+	_, err = upload(misaddressed, UploadOptions{SkipRecipientCheck: true})
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = upload(filepath.Join(dir, "sample.txt"), UploadOptions{Encrypt: true, PublicKey: writeKey("other.pub", otherPublicKey)})
+	if err == nil || !strings.Contains(err.Error(), "not the ingestion key") {
+		t.Error(err)
+	}
+	client, err := upload(filepath.Join(dir, "sample.txt"), UploadOptions{Encrypt: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = crypt4gh.NewCrypt4GHReader(bytes.NewReader(client.chunks["1"]), ingestionPrivateKey, nil)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEncryptedSize(t *testing.T) {
+	publicKey, _, err := keys.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, plaintextSize := range []int{0, 1, 65536, 65537, 200000} {
+		encrypted := bytes.Buffer{}
+		writer, err := crypt4gh.NewCrypt4GHWriterWithoutPrivateKey(&encrypted, [][32]byte{publicKey}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = writer.Write(make([]byte, plaintextSize))
+		_ = writer.Close()
+		size, err := encryptedSize(int64(plaintextSize), publicKey)
+		if err != nil || size != int64(encrypted.Len()) {
+			t.Error(plaintextSize, size, encrypted.Len(), err)
+		}
+	}
+}
+
 func TestUploadFolder(t *testing.T) {
-	err := uploader.Upload(dir, false, false)
+	err := uploader.Upload(context.Background(), dir, UploadOptions{})
 	if err == nil || !strings.HasSuffix(err.Error(), "not a Crypt4GH file") {
 		t.Error(err)
 	}
 }
 
+func TestUploadFolderInParallel(t *testing.T) {
+	err := uploader.Upload(context.Background(), dir, UploadOptions{Parallel: 2})
+	failures, ok := err.(*UploadFailuresError)
+	if !ok {
+		t.Fatal(err)
+	}
+	if failures.Total != 2 || len(failures.Failures) != 1 || filepath.Base(failures.Failures[0].Path) != "sample.txt" {
+		t.Error(err)
+	}
+}
+
+func TestUploadFailuresNamedInInbox(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"sample1/reads.bam", "sample2/reads.bam"} {
+		if err := os.MkdirAll(filepath.Join(root, filepath.Dir(name)), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, name), []byte("plaintext"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := uploader.Upload(context.Background(), root, UploadOptions{Recursive: true})
+	if err == nil || !strings.Contains(err.Error(), "\n  sample1/reads.bam: ") ||
+		!strings.Contains(err.Error(), "\n  sample2/reads.bam: ") {
+		t.Error(err)
+	}
+}
+
+func TestListFolder(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"a.c4gh", "b.txt", "sample1/a.c4gh", "sample2/a.c4gh", "tmp/c.c4gh"} {
+		err := os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filepath.Join(root, name), nil, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	fileNames := func(entries []folderEntry) string {
+		names := make([]string, 0)
+		for _, entry := range entries {
+			names = append(names, entry.fileName)
+		}
+		return strings.Join(names, ",")
+	}
+	entries, err := listFolder(root, UploadOptions{})
+	if err != nil || fileNames(entries) != "a.c4gh,b.txt,a.c4gh,a.c4gh,c.c4gh" {
+		t.Error(fileNames(entries), err)
+	}
+	unique, failures := sameNameEntries(entries)
+	if fileNames(unique) != "a.c4gh,b.txt,c.c4gh" || len(failures) != 2 ||
+		failures[0].Path != filepath.Join(root, "sample1/a.c4gh") || !strings.Contains(failures[0].Err.Error(), "--recursive") {
+		t.Error(fileNames(unique), failures)
+	}
+	entries, err = listFolder(root, UploadOptions{Recursive: true, Include: []string{"*.c4gh"}, Exclude: []string{"tmp"}})
+	if err != nil || fileNames(entries) != "a.c4gh,sample1/a.c4gh,sample2/a.c4gh" {
+		t.Error(fileNames(entries), err)
+	}
+	entries, err = listFolder(root, UploadOptions{Recursive: true, Prefix: "batch", Include: []string{"sample*/*"}})
+	if err != nil || fileNames(entries) != "batch/sample1/a.c4gh,batch/sample2/a.c4gh" {
+		t.Error(fileNames(entries), err)
+	}
+	_, err = listFolder(root, UploadOptions{Exclude: []string{"["}})
+	if err == nil {
+		t.Error()
+	}
+}
+
+func TestIsSameFile(t *testing.T) {
+	if !isSameFile("sample1/a.c4gh", "sample1/a.c4gh") || !isSameFile("/a.c4gh", "a.c4gh") {
+		t.Error("same files are not matched")
+	}
+	if isSameFile("sample1/a.c4gh", "a.c4gh") || isSameFile("a.c4gh", "sample1/a.c4gh") {
+		t.Error("files of different folders are matched")
+	}
+}
+
+type listingClient struct {
+	mockClient
+	listing string
+}
+
+func (c listingClient) DoRequest(ctx context.Context, method, url string, body io.Reader, headers, params map[string]string, username, password string) (*http.Response, error) {
+	if strings.HasSuffix(url, "/files") {
+		response := http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(c.listing))}
+		return &response, nil
+	}
+	return c.mockClient.DoRequest(ctx, method, url, body, headers, params, username, password)
+}
+
+func TestVerifySizeMismatch(t *testing.T) {
+	err := uploader.Verify(context.Background(), existingFile.Name(), UploadOptions{})
+	if err == nil || !strings.HasSuffix(err.Error(), "size is 100 bytes instead of 65688") {
+		t.Error(err)
+	}
+}
+
+func TestVerifyNotFound(t *testing.T) {
+	err := uploader.Verify(context.Background(), dir, UploadOptions{Prefix: "batch"})
+	verificationError, ok := err.(*VerificationError)
+	if !ok || len(verificationError.Mismatches) != 2 || verificationError.Mismatches[0].FileName != "batch/sample.txt" ||
+		verificationError.Mismatches[0].Reason != "not found" {
+		t.Error(err)
+	}
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	var client requests.Client = listingClient{listing: `{"files": [{"fileName": "test.enc", "size": 65688, "checksum": "91E93335245604993D0C2599FA22EFC2B607301BF1A9B2426A6489ADF6BF5AF6"}]}`}
+	streamer, err := NewStreamer(context.Background(), &client, nil, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = streamer.Verify(context.Background(), existingFile.Name(), UploadOptions{})
+	if err != nil {
+		t.Error(err)
+	}
+	client = listingClient{listing: `{"files": [{"fileName": "test.enc", "size": 65688, "checksum": "91e9"}]}`}
+	streamer, err = NewStreamer(context.Background(), &client, nil, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = streamer.Verify(context.Background(), existingFile.Name(), UploadOptions{})
+	if err == nil || !strings.Contains(err.Error(), "checksum is 91e9 instead of 91e93335") {
+		t.Error(err)
+	}
+}
+
 func TestDownloadFileRemoteDoesntExist(t *testing.T) {
-	err := uploader.Download("notfoundfile.enc")
+	err := uploader.Download(context.Background(), "notfoundfile.enc", DownloadOptions{})
 	if err == nil || !strings.HasSuffix(err.Error(), "not found in the outbox.") {
 		t.Error(err)
 	}
 }
 
 func TestDownloadFileRemoteExists(t *testing.T) {
-	err := uploader.Download("test2.enc")
+	err := uploader.Download(context.Background(), "test2.enc", DownloadOptions{})
 	if err != nil {
 		t.Error(err)
 	}
@@ -175,7 +1434,7 @@ func TestDownloadFileLocalExists(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	err = uploader.Download("test2.enc")
+	err = uploader.Download(context.Background(), "test2.enc", DownloadOptions{})
 	if err == nil || !strings.HasSuffix(err.Error(), "exists locally, aborting.") {
 		t.Error(err)
 	}
@@ -185,9 +1444,106 @@ func TestDownloadFileLocalExists(t *testing.T) {
 	}
 }
 
+func TestDownloadFileResume(t *testing.T) {
+	err := ioutil.WriteFile("test2.enc", []byte("te"), 0600)
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.Remove("test2.enc")
+	err = uploader.Download(context.Background(), "test2.enc", DownloadOptions{Resume: true})
+	if err != nil {
+		t.Error(err)
+	}
+	content, err := ioutil.ReadFile("test2.enc")
+	if err != nil || string(content) != "test" {
+		t.Error(string(content), err)
+	}
+	err = uploader.Download(context.Background(), "test2.enc", DownloadOptions{Resume: true})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDownloadFileLocalLarger(t *testing.T) {
+	err := ioutil.WriteFile("test2.enc", []byte("testtest"), 0600)
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.Remove("test2.enc")
+	err = uploader.Download(context.Background(), "test2.enc", DownloadOptions{Resume: true})
+	if err == nil || !strings.HasSuffix(err.Error(), "is larger locally than in the outbox, aborting.") {
+		t.Error(err)
+	}
+}
+
+type exportClient struct {
+	mockClient
+	content []byte
+}
+
+func (c exportClient) DoRequest(ctx context.Context, method, url string, body io.Reader, headers, params map[string]string, username, password string) (*http.Response, error) {
+	if strings.HasSuffix(url, "/files") {
+		listing := fmt.Sprintf(`{"files": [{"fileName": "export.txt.c4gh", "size": %v}]}`, len(c.content))
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(listing))}, nil
+	}
+	if strings.HasSuffix(url, "/stream/export.txt.c4gh") {
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewReader(c.content))}, nil
+	}
+	return c.mockClient.DoRequest(ctx, method, url, body, headers, params, username, password)
+}
+
+func TestDownloadFileDecrypted(t *testing.T) {
+	publicKey, privateKey, err := keys.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted := bytes.Buffer{}
+	writer, err := crypt4gh.NewCrypt4GHWriterWithoutPrivateKey(&encrypted, [][32]byte{publicKey}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = writer.Write([]byte("exported data"))
+	_ = writer.Close()
+	var client requests.Client = exportClient{content: encrypted.Bytes()}
+	streamer, err := NewStreamer(context.Background(), &client, nil, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, wrongKey, err := keys.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = streamer.Download(context.Background(), "export.txt.c4gh", DownloadOptions{PrivateKey: &wrongKey})
+	if err == nil || !strings.Contains(err.Error(), "header can not be decrypted with the given key") || fileExists("export.txt") {
+		t.Error(err)
+	}
+	corrupted := append([]byte{}, encrypted.Bytes()...)
+	corrupted[len(corrupted)-1] ^= 0xff
+	var corruptedClient requests.Client = exportClient{content: corrupted}
+	corruptedStreamer, err := NewStreamer(context.Background(), &corruptedClient, nil, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = corruptedStreamer.Download(context.Background(), "export.txt.c4gh", DownloadOptions{PrivateKey: &privateKey})
+	if err == nil || fileExists("export.txt") {
+		t.Error(err)
+	}
+	err = streamer.Download(context.Background(), "export.txt.c4gh", DownloadOptions{PrivateKey: &privateKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("export.txt")
+	content, err := ioutil.ReadFile("export.txt")
+	if err != nil || string(content) != "exported data" {
+		t.Error(string(content), err)
+	}
+}
+
 func teardown() {
 	_ = os.Unsetenv("CENTRAL_EGA_USERNAME")
 	_ = os.Unsetenv("CENTRAL_EGA_PASSWORD")
 	_ = os.Unsetenv("LOCAL_EGA_INSTANCE_URL")
 	_ = os.Unsetenv("ELIXIR_AAI_TOKEN")
+	_ = os.RemoveAll(os.Getenv("LEGA_COMMANDER_RESUME_JOURNAL"))
+	_ = os.Unsetenv("LEGA_COMMANDER_RESUME_JOURNAL")
 }
@@ -0,0 +1,117 @@
+package streaming
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/elixir-oslo/lega-commander/conf"
+	"github.com/golang-jwt/jwt"
+)
+
+// tsdTokenRenewalMargin is how long before its expiry the TSD token is requested anew.
+const tsdTokenRenewalMargin = 2 * time.Minute
+
+// tsdToken structure holds the TSD token of the straight transfers along with its claims, shared by all the workers.
+// The token is requested anew from the proxy before it expires, or once it is rejected.
+type tsdToken struct {
+	mutex  sync.Mutex
+	token  string
+	claims jwt.MapClaims
+	expiry time.Time
+	renew  func(ctx context.Context) (string, jwt.MapClaims, error)
+}
+
+// newTSDToken constructs tsdToken of the token issued by the proxy, using renew to request the next one.
+func newTSDToken(token string, claims jwt.MapClaims, renew func(ctx context.Context) (string, jwt.MapClaims, error)) *tsdToken {
+	return &tsdToken{token: token, claims: claims, expiry: claimsExpiry(claims), renew: renew}
+}
+
+// get returns the token, renewing it first if it is about to expire or if it is the rejected one.
+func (t *tsdToken) get(ctx context.Context, rejected string) (string, error) {
+	token, _, err := t.current(ctx, rejected)
+	return token, err
+}
+
+// user returns the TSD user the token is issued to, whose files the straight transfers address.
+func (t *tsdToken) user(ctx context.Context) (string, error) {
+	_, claims, err := t.current(ctx, "")
+	if err != nil {
+		return "", err
+	}
+	user, ok := claims["user"].(string)
+	if !ok || user == "" {
+		return "", errors.New("TSD token does not tell the user the files belong to")
+	}
+	return user, nil
+}
+
+// current returns the token and its claims, renewing the token first if it is about to expire or if it is the
+// rejected one.
+func (t *tsdToken) current(ctx context.Context, rejected string) (string, jwt.MapClaims, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.token != rejected && (t.expiry.IsZero() || time.Until(t.expiry) > tsdTokenRenewalMargin) {
+		return t.token, t.claims, nil
+	}
+	token, claims, err := t.renew(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	t.token, t.claims, t.expiry = token, claims, claimsExpiry(claims)
+	return t.token, t.claims, nil
+}
+
+// claimsExpiry returns the time the "exp" claim tells, zero if there is none.
+func claimsExpiry(claims jwt.MapClaims) time.Time {
+	switch exp := claims["exp"].(type) {
+	case float64:
+		return time.Unix(int64(exp), 0)
+	case json.Number:
+		seconds, err := exp.Int64()
+		if err == nil {
+			return time.Unix(seconds, 0)
+		}
+	}
+	return time.Time{}
+}
+
+// doWithTSDToken performs the request with the TSD token, repeating it once with the new token if it gets rejected.
+func (s defaultStreamer) doWithTSDToken(ctx context.Context, request func(token string) (*http.Response, error)) (*http.Response, error) {
+	token, err := s.tsdToken.get(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	response, err := request(token)
+	if err != nil || response.StatusCode != http.StatusUnauthorized {
+		return response, err
+	}
+	response.Body.Close()
+	if token, err = s.tsdToken.get(ctx, token); err != nil {
+		return nil, err
+	}
+	return request(token)
+}
+
+// doWithAAIToken performs the request with the ELIXIR AAI token, repeating it once if it gets rejected and the token,
+// obtained with the login command, could be refreshed.
+func doWithAAIToken(ctx context.Context, request func(token string) (*http.Response, error)) (*http.Response, error) {
+	token := conf.NewConfiguration().GetElixirAAIToken()
+	response, err := request(token)
+	if err != nil || response.StatusCode != http.StatusUnauthorized {
+		return response, err
+	}
+	refreshed, err := conf.RefreshElixirAAIToken(ctx, token)
+	if err != nil {
+		response.Body.Close()
+		return nil, err
+	}
+	if !refreshed {
+		return response, nil
+	}
+	response.Body.Close()
+	return request(conf.NewConfiguration().GetElixirAAIToken())
+}
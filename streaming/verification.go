@@ -0,0 +1,153 @@
+package streaming
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/elixir-oslo/lega-commander/files"
+	aurora "github.com/logrusorgru/aurora/v3"
+)
+
+// Mismatch structure represents a local file that does not match its counterpart in the inbox.
+type Mismatch struct {
+	FileName string
+	Reason   string
+}
+
+// VerificationError is returned when some of the local files do not match the files in the inbox.
+type VerificationError struct {
+	Mismatches []Mismatch
+}
+
+// Error returns the list of the mismatching files.
+func (e *VerificationError) Error() string {
+	lines := make([]string, 0, len(e.Mismatches))
+	for _, mismatch := range e.Mismatches {
+		lines = append(lines, "File "+mismatch.FileName+" does not match the inbox: "+mismatch.Reason)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Verify method checks that the file or the files of the folder are present in the inbox with the same size and,
+// if the inbox listing provides it, the same SHA-256 checksum as the local ones. The options are used to
+// derive the names of the files in the inbox the same way the upload does.
+func (s defaultStreamer) Verify(ctx context.Context, path string, options UploadOptions) error {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !stat.IsDir() {
+		return s.verifyEntries(ctx, []folderEntry{{path, inboxFileName(options.Prefix, filepath.Base(path))}})
+	}
+	entries, err := listFolder(path, options)
+	if err != nil {
+		return err
+	}
+	return s.verifyEntries(ctx, entries)
+}
+
+// expectedFile structure represents a file expected to be found in the inbox. The checksum is only calculated if
+// the inbox listing provides one to compare it with.
+type expectedFile struct {
+	fileName string
+	size     int64
+	checksum func() (string, error)
+}
+
+func (s defaultStreamer) verifyEntries(ctx context.Context, entries []folderEntry) error {
+	expectedFiles := make([]expectedFile, 0, len(entries))
+	for _, entry := range entries {
+		stat, err := os.Stat(entry.path)
+		if err != nil {
+			return err
+		}
+		path := entry.path
+		expectedFiles = append(expectedFiles, expectedFile{entry.fileName, stat.Size(), func() (string, error) {
+			return fileChecksum(path)
+		}})
+	}
+	return s.verifyFiles(ctx, expectedFiles)
+}
+
+// verifyUploadedFiles checks the files that have just been uploaded against a single listing of the inbox, using the
+// sizes and the checksums of the bytes that were actually sent, which differ from the local files when they were
+// encrypted during the upload.
+func (s defaultStreamer) verifyUploadedFiles(ctx context.Context, uploadedFiles []UploadedFile) error {
+	expectedFiles := make([]expectedFile, 0, len(uploadedFiles))
+	for _, uploadedFile := range uploadedFiles {
+		checksum := uploadedFile.SHA256
+		expectedFiles = append(expectedFiles, expectedFile{uploadedFile.FileName, uploadedFile.Size, func() (string, error) {
+			return checksum, nil
+		}})
+	}
+	return s.verifyFiles(ctx, expectedFiles)
+}
+
+func (s defaultStreamer) verifyFiles(ctx context.Context, expectedFiles []expectedFile) error {
+	filesList, err := s.fileManager.ListFiles(ctx, true)
+	if err != nil {
+		return err
+	}
+	mismatches := make([]Mismatch, 0)
+	for _, expected := range expectedFiles {
+		reason, err := verifyFile(expected, filesList)
+		if err != nil {
+			return err
+		}
+		if reason != "" {
+			mismatches = append(mismatches, Mismatch{expected.fileName, reason})
+			continue
+		}
+		s.report(aurora.Green("Verified: " + expected.fileName).String())
+	}
+	if len(mismatches) != 0 {
+		return &VerificationError{mismatches}
+	}
+	return nil
+}
+
+// verifyFile returns the reason the expected file does not match the inbox, or an empty string if it does.
+func verifyFile(expected expectedFile, filesList *[]files.File) (string, error) {
+	for _, uploadedFile := range *filesList {
+		if !isSameFile(uploadedFile.FileName, expected.fileName) {
+			continue
+		}
+		if uploadedFile.Size != expected.size {
+			return "size is " + strconv.FormatInt(uploadedFile.Size, 10) + " bytes instead of " +
+				strconv.FormatInt(expected.size, 10), nil
+		}
+		if uploadedFile.Checksum == "" {
+			return "", nil
+		}
+		checksum, err := expected.checksum()
+		if err != nil {
+			return "", err
+		}
+		if !strings.EqualFold(uploadedFile.Checksum, checksum) {
+			return "checksum is " + uploadedFile.Checksum + " instead of " + checksum, nil
+		}
+		return "", nil
+	}
+	return "not found", nil
+}
+
+// fileChecksum calculates SHA-256 checksum of the file.
+func fileChecksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hashFunction := sha256.New()
+	if _, err = io.Copy(hashFunction, file); err != nil {
+		return "", errors.New(path + ": " + err.Error())
+	}
+	return hex.EncodeToString(hashFunction.Sum(nil)), nil
+}